@@ -17,15 +17,13 @@
 package archive
 
 import (
-	"archive/tar"
 	"archive/zip"
-	"fmt"
+	"bytes"
 	"github.com/getsolus/libeopkg/shared"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
-	"syscall"
 )
 
 //
@@ -55,27 +53,51 @@ type Archive struct {
 	// Files for this package
 	Files *Files
 	// .eopkg is a zip archive
-	zipFile *zip.ReadCloser
+	zipFile *zip.Reader
+	// Underlying file, when opened from a path
+	closer io.Closer
+	// Lazily indexed view of the install tarball
+	payload *PayloadFS
 }
 
 // Open will attempt to open the given .eopkg file.
 // This must be a valid .eopkg file and this stage will assert that it is
 // indeed a real archive.
 func Open(path string) (a *Archive, err error) {
+	// Open package file
+	zipFile, err := zip.OpenReader(path)
+	if err != nil {
+		return
+	}
 	// Create package object
 	a = &Archive{
-		Path: path,
-		ID:   filepath.Base(path),
+		Path:    path,
+		ID:      filepath.Base(path),
+		zipFile: &zipFile.Reader,
+		closer:  zipFile,
 	}
-	// Open package file
-	zipFile, err := zip.OpenReader(path)
+	return
+}
+
+// OpenReader will attempt to open an .eopkg from any io.ReaderAt holding size
+// bytes, such as an upload in memory or an HTTP range reader. As there is no
+// file, Path and ID are left empty for the caller to fill in.
+func OpenReader(r io.ReaderAt, size int64) (a *Archive, err error) {
+	zipFile, err := zip.NewReader(r, size)
 	if err != nil {
 		return
 	}
-	a.zipFile = zipFile
+	a = &Archive{
+		zipFile: zipFile,
+	}
 	return
 }
 
+// OpenBytes will attempt to open an .eopkg held entirely in memory
+func OpenBytes(data []byte) (*Archive, error) {
+	return OpenReader(bytes.NewReader(data), int64(len(data)))
+}
+
 // OpenAll will Open an Archive and ReadAll of its metadata
 func OpenAll(path string) (a *Archive, err error) {
 	if a, err = Open(path); err != nil {
@@ -90,9 +112,10 @@ func (a *Archive) Close() error {
 	if a == nil {
 		return nil
 	}
-	if a.zipFile != nil {
-		err := a.zipFile.Close()
-		a.zipFile = nil
+	a.zipFile = nil
+	if a.closer != nil {
+		err := a.closer.Close()
+		a.closer = nil
 		return err
 	}
 	return nil
@@ -126,30 +149,110 @@ func (a *Archive) ReadAll() error {
 	return a.ReadFiles()
 }
 
-// ExtractTarball will fully extract install.tar.xz to the destination direction + install.tar suffix
+// ExtractTarball will fully decompress the install tarball to the destination
+// directory + install.tar suffix, whichever codec was used to compress it
 func (a *Archive) ExtractTarball(directory string) error {
-	// Unpack tarball
-	if err := a.UnpackFile("install.tar.xz", directory); err != nil {
+	// Decompress straight out of the zip container
+	src, err := a.openPayload()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(filepath.Join(directory, "install.tar"))
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	if _, err = io.Copy(dst, src); err != nil {
 		return err
 	}
-	// Uncompress the tarball
-	xzName := filepath.Join(directory, "install.tar.xz")
-	return shared.UnxzFile(xzName, false)
+	return dst.Sync()
 }
 
-// setXattrs, applies Xattrs to a file, as they are stored in `tar.Header.PAXRecords`
-func setXattrs(path string, paxattrs map[string]string) error {
-	for attr, value := range paxattrs {
-		fmt.Printf("attr: %s, value: %s\n", attr, value)
-		if !strings.HasPrefix(attr, "SCHILY.xattr.") {
-			continue
-		}
-		name := strings.TrimPrefix(attr, "SCHILY.xattr.")
-		if err := syscall.Setxattr(path, name, []byte(value), 0); err != nil {
-			return err
+// findPayload locates the install tarball within the zip container, and
+// guesses its codec from the name
+func (a *Archive) findPayload() (*zip.File, shared.Codec, error) {
+	return a.findTarball(shared.TarballPrefix)
+}
+
+// findTarball locates the first tarball named with prefix
+func (a *Archive) findTarball(prefix string) (*zip.File, shared.Codec, error) {
+	for _, f := range a.zipFile.File {
+		if strings.HasPrefix(f.Name, prefix) {
+			codec, _ := shared.CodecFromName(f.Name)
+			return f, codec, nil
 		}
 	}
-	return nil
+	return nil, "", shared.ErrEopkgCorrupted
+}
+
+// PayloadCodec determines how the install tarball was compressed
+func (a *Archive) PayloadCodec() (shared.Codec, error) {
+	srcFile, named, err := a.findPayload()
+	if err != nil {
+		return "", err
+	}
+	src, err := srcFile.Open()
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	codec, _, err := sniffPayload(src, named)
+	return codec, err
+}
+
+// sniffPayload prefers the magic number of the stream over its name, as
+// only the legacy lzma format cannot be detected
+func sniffPayload(src io.Reader, named shared.Codec) (shared.Codec, io.Reader, error) {
+	codec, in, err := shared.SniffCodec(src)
+	if err == shared.ErrUnsupportedCodec && named != "" {
+		return named, in, nil
+	}
+	return codec, in, err
+}
+
+// openPayload opens a decompressed stream of the install tarball straight
+// from the zip container, without writing anything to disk
+func (a *Archive) openPayload() (io.ReadCloser, error) {
+	return a.openTarball(shared.TarballPrefix)
+}
+
+// openTarball decompresses the first tarball named with prefix
+func (a *Archive) openTarball(prefix string) (io.ReadCloser, error) {
+	srcFile, named, err := a.findTarball(prefix)
+	if err != nil {
+		return nil, err
+	}
+	src, err := srcFile.Open()
+	if err != nil {
+		return nil, err
+	}
+	codec, in, err := sniffPayload(src, named)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	rc, err := shared.NewReader(codec, in, shared.DefaultCompressOptions)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	return &payloadReader{rc, src}, nil
+}
+
+// payloadReader closes both the decompressor and the zip member
+type payloadReader struct {
+	io.ReadCloser
+	member io.Closer
+}
+
+// Close the decompressor, followed by the zip member
+func (p *payloadReader) Close() error {
+	err := p.ReadCloser.Close()
+	if merr := p.member.Close(); err == nil {
+		err = merr
+	}
+	return err
 }
 
 // UnpackFile copies file from Zip to destination
@@ -177,7 +280,26 @@ func (a *Archive) UnpackFile(name, path string) error {
 
 // Unpack writes out 'files.xml' and 'metadata.xml', then unpacks the tarball to "install"
 func (a *Archive) Unpack(metaPath, filesPath string) error {
-	// Unpack metadata files
+	return a.UnpackWith(metaPath, filesPath, UnpackOptions{})
+}
+
+// UnpackWith is Unpack, but with control over ownership. A rootless or
+// remapped unpack also writes the OwnershipFile sidecar into metaPath.
+func (a *Archive) UnpackWith(metaPath, filesPath string, opts UnpackOptions) error {
+	if err := a.unpackMetadata(metaPath, filesPath); err != nil {
+		return err
+	}
+	// Extract the tarball, confined to filesPath
+	ownership, err := a.unpackTarball(filesPath, opts)
+	if err != nil || ownership == nil {
+		return err
+	}
+	return ownership.Save(metaPath)
+}
+
+// unpackMetadata writes out files.xml and metadata.xml, and makes sure the
+// root exists for the tarball
+func (a *Archive) unpackMetadata(metaPath, filesPath string) error {
 	// Make dir to unpack things into
 	if err := os.MkdirAll(metaPath, 0755); err != nil {
 		return err
@@ -189,82 +311,22 @@ func (a *Archive) Unpack(metaPath, filesPath string) error {
 		return err
 	}
 	// Make subdir to unpack things into
-	if err := os.MkdirAll(filesPath, 0755); err != nil {
-		return err
-	}
-	// Unpack the existing tarball from zip container and decompressing it
-	if err := a.ExtractTarball(filesPath); err != nil {
-		return err
-	}
-	// Open the tarball
-	srcFile := filepath.Join(filesPath, "install.tar")
-	f, err := os.Open(srcFile)
-	if err != nil {
-		return err
-	}
-	defer os.Remove(srcFile)
-	defer f.Close()
-	src := tar.NewReader(f)
-	// Iterate over tarball contents
-	header, err := src.Next()
-	for err == nil && header != nil {
-		dstPath := filepath.Join(filesPath, header.Name)
-		if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
-			return err
-		}
-		// make the output directory
-		switch header.Typeflag {
-		case tar.TypeReg, tar.TypeRegA:
-			dst, err := os.OpenFile(dstPath, os.O_RDWR|os.O_CREATE, os.FileMode(header.Mode))
-			if err != nil {
-				return err
-			}
-			_, err = io.Copy(dst, src)
-			_ = dst.Sync()
-			_ = dst.Close()
-		case tar.TypeLink:
-			err = os.Link(header.Linkname, dstPath)
-		case tar.TypeSymlink:
-			err = os.Symlink(header.Linkname, dstPath)
-		case tar.TypeDir:
-			err = os.MkdirAll(dstPath, 0755)
-		case tar.TypeFifo:
-			err = syscall.Mkfifo(dstPath, 0666)
-		default:
-			// unexpected
-			continue
-		}
-		if err != nil {
-			return err
-		}
-		if err = os.Chown(dstPath, header.Uid, header.Gid); err != nil {
-			return err
-		}
-		if err = os.Chtimes(dstPath, header.AccessTime, header.ModTime); err != nil {
-			return err
-		}
-		if err = setXattrs(dstPath, header.PAXRecords); err != nil {
-			return err
-		}
-		header, err = src.Next()
-	}
-	if err == io.EOF {
-		err = nil
-	}
-	return err
+	return os.MkdirAll(filesPath, 0755)
 }
 
-// Verify validates all of the files on disk against the archive
+// Verify validates all of the files on disk against the archive, stopping
+// at the first problem. Check reports every problem instead.
 func (a *Archive) Verify(path string) error {
-	if err := a.ReadAll(); err != nil {
+	return a.VerifyWith(path, VerifyOptions{})
+}
+
+// VerifyWith is Verify, but with control over how ownership is checked
+func (a *Archive) VerifyWith(path string, opts VerifyOptions) error {
+	report, err := a.CheckWith(path, opts)
+	if err != nil {
 		return err
 	}
-	for _, file := range a.Files.File {
-		if err := file.Verify(path); err != nil {
-			return err
-		}
-	}
-	return nil
+	return report.Err()
 }
 
 // IsDeltaPossible checks is a delta can be made from the two provided packages
@@ -17,8 +17,16 @@
 package archive
 
 import (
+	"archive/zip"
+	"crypto/sha1"
 	"fmt"
+	"github.com/getsolus/libeopkg/shared"
+	"io"
+	"io/fs"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -107,3 +115,147 @@ func TestArchiveUnpack(t *testing.T) {
 	}
 	os.RemoveAll("TESTING")
 }
+
+// recompress writes a copy of the package at src to dst, with the install
+// tarball compressed using a different codec
+func recompress(t *testing.T, src, dst string, codec shared.Codec) {
+	pkg, err := Open(src)
+	if err != nil {
+		t.Fatalf("Error opening valid .eopkg file: %v", err)
+	}
+	defer pkg.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		t.Fatalf("Failed to create package: %v", err)
+	}
+	defer out.Close()
+	zw := zip.NewWriter(out)
+	for _, f := range pkg.zipFile.File {
+		var in io.ReadCloser
+		name := f.Name
+		if strings.HasPrefix(name, shared.TarballPrefix) {
+			name = codec.TarballName()
+			in, err = pkg.openPayload()
+		} else {
+			in, err = f.Open()
+		}
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", f.Name, err)
+		}
+		dst, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+		var w io.Writer = dst
+		var cw io.WriteCloser
+		if name != f.Name {
+			opts := shared.CompressOptions{Level: 1, Threads: 1, Backend: shared.BackendNative}
+			if codec == shared.CodecBzip2 {
+				opts.Backend = shared.BackendExec
+			}
+			if cw, err = shared.NewWriter(codec, dst, opts); err != nil {
+				t.Fatalf("Failed to create %s compressor: %v", codec, err)
+			}
+			w = cw
+		}
+		if _, err = io.Copy(w, in); err != nil {
+			t.Fatalf("Failed to copy %s: %v", f.Name, err)
+		}
+		if cw != nil {
+			if err = cw.Close(); err != nil {
+				t.Fatalf("Failed to compress %s: %v", name, err)
+			}
+		}
+		in.Close()
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatalf("Failed to finish package: %v", err)
+	}
+}
+
+func TestArchiveCodecs(t *testing.T) {
+	dir := t.TempDir()
+	for _, codec := range []shared.Codec{shared.CodecGzip, shared.CodecBzip2, shared.CodecLzma, shared.CodecZstd} {
+		t.Run(string(codec), func(t *testing.T) {
+			// bzip2 can only be written by the host tool
+			if codec == shared.CodecBzip2 {
+				if _, err := exec.LookPath("bzip2"); err != nil {
+					t.Skip("bzip2 is not installed")
+				}
+			}
+			path := filepath.Join(dir, "nano"+codec.Extension()+".eopkg")
+			recompress(t, eopkgTestFile, path, codec)
+			pkg, err := OpenAll(path)
+			if err != nil {
+				t.Fatalf("Error opening %s package: %v", codec, err)
+			}
+			defer pkg.Close()
+			detected, err := pkg.PayloadCodec()
+			if err != nil {
+				t.Fatalf("Failed to detect payload codec: %v", err)
+			}
+			if detected != codec {
+				t.Fatalf("Detected %s payload as %s", codec, detected)
+			}
+			data, err := fs.ReadFile(pkg.FS(), "usr/bin/nano")
+			if err != nil {
+				t.Fatalf("Failed to read from %s payload: %v", codec, err)
+			}
+			if sum := fmt.Sprintf("%x", sha1.Sum(data)); sum != "730862fbf8b3a98371419daa698ca8c645857e1c" {
+				t.Fatalf("Hash mismatch reading from %s payload: %s", codec, sum)
+			}
+		})
+	}
+}
+
+func TestArchiveOpenBytes(t *testing.T) {
+	data, err := os.ReadFile(eopkgTestFile)
+	if err != nil {
+		t.Fatalf("Failed to read test package: %v", err)
+	}
+	if _, err = OpenBytes(data[:len(data)/2]); err == nil {
+		t.Fatal("Opened a truncated archive!")
+	}
+	pkg, err := OpenBytes(data)
+	if err != nil {
+		t.Fatalf("Error opening valid .eopkg bytes: %v", err)
+	}
+	defer pkg.Close()
+	if err = pkg.ReadAll(); err != nil {
+		t.Fatalf("Error reading metadata: %v", err)
+	}
+	if pkg.Meta.Package.Name != "nano" {
+		t.Fatalf("Incorrect package name: %s", pkg.Meta.Package.Name)
+	}
+	dir := t.TempDir()
+	install := filepath.Join(dir, "install")
+	if err = pkg.Unpack(dir, install); err != nil {
+		t.Fatalf("Could not unpack .eopkg bytes: %v", err)
+	}
+	if err = pkg.Verify(install); err != nil {
+		t.Fatalf("Verification failed: %v", err)
+	}
+}
+
+func TestArchiveOpenReader(t *testing.T) {
+	f, err := os.Open(eopkgTestFile)
+	if err != nil {
+		t.Fatalf("Failed to open test package: %v", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatalf("Failed to stat test package: %v", err)
+	}
+	pkg, err := OpenReader(f, info.Size())
+	if err != nil {
+		t.Fatalf("Error opening valid .eopkg reader: %v", err)
+	}
+	defer pkg.Close()
+	if err = pkg.ReadFiles(); err != nil {
+		t.Fatalf("Error reading files: %v", err)
+	}
+	if err = pkg.ExtractTarball(t.TempDir()); err != nil {
+		t.Fatalf("Failed to extract tarball: %v", err)
+	}
+}
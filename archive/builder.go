@@ -0,0 +1,307 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"crypto/sha1"
+	"fmt"
+	"github.com/getsolus/libeopkg/shared"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// PackageFormat is the version of the .eopkg format written by Builder
+const PackageFormat = "1.2"
+
+// Builder creates a new .eopkg from a staged install root, as ypkg does
+type Builder struct {
+	// Root is the staged install root
+	Root string
+	// Meta is written out as metadata.xml. InstalledSize, PackageSize and
+	// PackageHash are filled in by Build.
+	Meta *Metadata
+	// Files selects what to include from Root, and the Type of each. When
+	// nil, everything under Root is included as FileData. Only the Path and
+	// Type of each File are used.
+	Files *Files
+	// Codec is used to compress the install tarball
+	Codec shared.Codec
+	// Compression controls how the install tarball is compressed
+	Compression shared.CompressOptions
+	// Reproducible, when set, makes the package depend only on the staged
+	// files and metadata
+	Reproducible *Reproducible
+}
+
+// NewBuilder creates a Builder for the staged root, with default compression
+func NewBuilder(root string, meta *Metadata) *Builder {
+	return &Builder{
+		Root:        root,
+		Meta:        meta,
+		Codec:       shared.CodecXz,
+		Compression: shared.DefaultCompressOptions,
+	}
+}
+
+// buildEntry is a File along with what is needed to add it to the tarball
+type buildEntry struct {
+	file *File
+	info fs.FileInfo
+	// link is the target of a symlink
+	link string
+	// hardlink is the Path of an earlier entry sharing the same inode
+	hardlink string
+}
+
+// selection lists the paths to include along with their type, in the order
+// they will appear in the package
+func (b *Builder) selection() ([]*File, error) {
+	if b.Files == nil {
+		staged, err := ListStaged(b.Root)
+		if err != nil {
+			return nil, err
+		}
+		return staged.File, nil
+	}
+	files := make([]*File, len(b.Files.File))
+	copy(files, b.Files.File)
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+// ListStaged finds everything in a staged install root which would go into a
+// package, sorted by Path and with every Type set to FileData. Directories
+// are only included when empty, as with eopkg.
+func ListStaged(root string) (*Files, error) {
+	var files []*File
+	parents := make(map[string]bool)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		parents[path.Dir(rel)] = true
+		files = append(files, &File{Path: rel, Type: shared.FileData})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	staged := &Files{}
+	for _, file := range files {
+		if !parents[file.Path] {
+			staged.File = append(staged.File, file)
+		}
+	}
+	// WalkDir visits "a/b" before "a/b-c", but not "a/b/c"
+	sort.Slice(staged.File, func(i, j int) bool { return staged.File[i].Path < staged.File[j].Path })
+	staged.Reindex()
+	return staged, nil
+}
+
+// describe builds the files.xml entry for a file in the staged root
+func (b *Builder) describe(file *File, inodes map[[2]uint64]string) (*buildEntry, error) {
+	src := filepath.Join(b.Root, filepath.FromSlash(file.Path))
+	info, err := os.Lstat(src)
+	if err != nil {
+		return nil, err
+	}
+	stat := info.Sys().(*syscall.Stat_t)
+	entry := &buildEntry{
+		file: &File{
+			Path: file.Path,
+			Type: file.Type,
+			UID:  int(stat.Uid),
+			GID:  int(stat.Gid),
+			Mode: FileMode(stat.Mode & 07777),
+		},
+		info: info,
+	}
+	h := sha1.New()
+	switch mode := info.Mode(); {
+	case mode.IsDir():
+		// Directories are indicated by a missing hash
+		return entry, nil
+	case mode&os.ModeSymlink != 0:
+		if entry.link, err = os.Readlink(src); err != nil {
+			return nil, err
+		}
+		io.WriteString(h, entry.link)
+		entry.file.Size = int64(len(entry.link))
+	case mode.IsRegular():
+		inode := [2]uint64{uint64(stat.Dev), uint64(stat.Ino)}
+		if stat.Nlink > 1 {
+			if first, ok := inodes[inode]; ok {
+				entry.hardlink = first
+			} else {
+				inodes[inode] = file.Path
+			}
+		}
+		f, err := os.Open(src)
+		if err != nil {
+			return nil, err
+		}
+		entry.file.Size, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("'%s' is a %s, which cannot be packaged", file.Path, mode.Type())
+	}
+	entry.file.Hash = fmt.Sprintf("%x", h.Sum(nil))
+	return entry, nil
+}
+
+// Build writes the package to path, returning the generated files.xml. The
+// metadata is updated with the InstalledSize, PackageSize and PackageHash of
+// the new package.
+func (b *Builder) Build(path string) (*Files, error) {
+	selected, err := b.selection()
+	if err != nil {
+		return nil, err
+	}
+	files := &Files{}
+	entries := make([]*buildEntry, 0, len(selected))
+	inodes := make(map[[2]uint64]string)
+	var installed int64
+	for _, file := range selected {
+		entry, err := b.describe(file, inodes)
+		if err != nil {
+			return nil, err
+		}
+		installed += entry.file.Size
+		entries = append(entries, entry)
+		files.File = append(files.File, entry.file)
+	}
+	files.Reindex()
+	pkg := b.Meta.Package
+	pkg.InstalledSize = installed
+	pkg.PackageSize, pkg.PackageHash = 0, ""
+	if pkg.PackageFormat == "" {
+		pkg.PackageFormat = PackageFormat
+	}
+	if err = b.write(path, files, entries); err != nil {
+		return nil, err
+	}
+	// Only known once the package is complete, so these are for the index
+	if pkg.PackageSize, pkg.PackageHash, err = hashPackage(path); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// write assembles the zip container, in the same order as eopkg
+func (b *Builder) write(path string, files *Files, entries []*buildEntry) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	zw := zip.NewWriter(out)
+	w, err := zw.CreateHeader(b.Reproducible.newZipHeader("metadata.xml", zip.Deflate))
+	if err != nil {
+		return err
+	}
+	if err = b.Meta.Encode(w); err != nil {
+		return err
+	}
+	if w, err = zw.CreateHeader(b.Reproducible.newZipHeader("files.xml", zip.Deflate)); err != nil {
+		return err
+	}
+	if err = files.Encode(w); err != nil {
+		return err
+	}
+	cw, err := b.Reproducible.createTarball(zw, b.Codec.TarballName(), b.Codec, b.Compression)
+	if err != nil {
+		return err
+	}
+	if err = b.writeTarball(cw, entries); err != nil {
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// writeTarball writes every entry into the install tarball, and closes it
+func (b *Builder) writeTarball(cw io.WriteCloser, entries []*buildEntry) error {
+	tw := tar.NewWriter(cw)
+	for _, entry := range entries {
+		header, err := tar.FileInfoHeader(entry.info, entry.link)
+		if err != nil {
+			return err
+		}
+		header.Name = entry.file.Path
+		if entry.info.IsDir() {
+			header.Name += "/"
+		}
+		if entry.hardlink != "" {
+			header.Typeflag = tar.TypeLink
+			header.Linkname = entry.hardlink
+			header.Size = 0
+		}
+		b.Reproducible.tarHeader(header)
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		f, err := os.Open(filepath.Join(b.Root, filepath.FromSlash(entry.file.Path)))
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(tw, f, header.Size)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("'%s' changed while packaging: %w", entry.file.Path, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// hashPackage finds the size and SHA-1 of a complete package, as listed in
+// the index
+func hashPackage(path string) (size int64, hash string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	h := sha1.New()
+	if size, err = io.Copy(h, f); err != nil {
+		return
+	}
+	hash = fmt.Sprintf("%x", h.Sum(nil))
+	return
+}
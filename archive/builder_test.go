@@ -0,0 +1,140 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"archive/tar"
+	"crypto/sha1"
+	"fmt"
+	"github.com/getsolus/libeopkg/shared"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fastBuilder creates a Builder which compresses as quickly as possible
+func fastBuilder(root string, meta *Metadata) *Builder {
+	b := NewBuilder(root, meta)
+	b.Compression = shared.CompressOptions{Level: 0, Threads: 1}
+	return b
+}
+
+func TestBuilderRebuild(t *testing.T) {
+	pkg, root := unpackNano(t)
+	if err := pkg.ReadAll(); err != nil {
+		t.Fatalf("Error reading package: %v", err)
+	}
+	b := fastBuilder(root, pkg.Meta)
+	b.Files = pkg.Files
+	path := filepath.Join(t.TempDir(), "nano.eopkg")
+	files, err := b.Build(path)
+	if err != nil {
+		t.Fatalf("Failed to build package: %v", err)
+	}
+	if len(files.File) != len(pkg.Files.File) {
+		t.Fatalf("Expected %d files, got %d", len(pkg.Files.File), len(files.File))
+	}
+	if files.indexed != len(files.File) {
+		t.Fatal("Built files should be indexed for lookups")
+	}
+	for i, file := range files.File {
+		if !file.Equal(pkg.Files.File[i]) {
+			t.Fatalf("Rebuilt file differs: %+v != %+v", file, pkg.Files.File[i])
+		}
+	}
+	if size := b.Meta.Package.InstalledSize; size != 2288096 {
+		t.Fatalf("Incorrect installed size: %d", size)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read package: %v", err)
+	}
+	if b.Meta.Package.PackageSize != int64(len(data)) || b.Meta.Package.PackageHash != fmt.Sprintf("%x", sha1.Sum(data)) {
+		t.Fatalf("Incorrect package size or hash")
+	}
+	built, err := OpenAll(path)
+	if err != nil {
+		t.Fatalf("Failed to open built package: %v", err)
+	}
+	defer built.Close()
+	if built.Meta.Package.Name != "nano" || built.Meta.Package.GetRelease() != 118 {
+		t.Fatalf("Incorrect metadata in built package")
+	}
+	if problems, err := built.CheckIntegrity(); err != nil || len(problems) != 0 {
+		t.Fatalf("Built package is inconsistent: %v %v", problems, err)
+	}
+}
+
+func TestBuilderWalk(t *testing.T) {
+	root := t.TempDir()
+	for _, err := range []error{
+		os.MkdirAll(filepath.Join(root, "usr/bin"), 0755),
+		os.MkdirAll(filepath.Join(root, "var/empty"), 0700),
+		os.WriteFile(filepath.Join(root, "usr/bin/tool"), []byte("tool"), 0755),
+		os.Link(filepath.Join(root, "usr/bin/tool"), filepath.Join(root, "usr/bin/tool-link")),
+		os.Symlink("tool", filepath.Join(root, "usr/bin/alias")),
+	} {
+		if err != nil {
+			t.Fatalf("Failed to stage files: %v", err)
+		}
+	}
+	pkg := craftPackage(t)
+	defer pkg.Close()
+	if err := pkg.ReadMetadata(); err != nil {
+		t.Fatalf("Error reading metadata: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "crafted.eopkg")
+	files, err := fastBuilder(root, pkg.Meta).Build(path)
+	if err != nil {
+		t.Fatalf("Failed to build package: %v", err)
+	}
+	expected := []string{"usr/bin/alias", "usr/bin/tool", "usr/bin/tool-link", "var/empty"}
+	if len(files.File) != len(expected) {
+		t.Fatalf("Expected %d files, got %d", len(expected), len(files.File))
+	}
+	for i, file := range files.File {
+		if file.Path != expected[i] || file.Type != shared.FileData {
+			t.Fatalf("Expected %s, got %s", expected[i], file.Path)
+		}
+	}
+	if dir := files.File[3]; dir.Hash != "" || dir.Mode != 0700 {
+		t.Fatalf("Empty directory listed incorrectly: %+v", dir)
+	}
+	built, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open built package: %v", err)
+	}
+	defer built.Close()
+	f, err := built.openPayload()
+	if err != nil {
+		t.Fatalf("Failed to open payload: %v", err)
+	}
+	defer f.Close()
+	links := make(map[string]string)
+	tr := tar.NewReader(f)
+	for header, err := tr.Next(); err == nil; header, err = tr.Next() {
+		if header.Typeflag == tar.TypeLink {
+			links[header.Name] = header.Linkname
+		}
+	}
+	if len(links) != 1 || links["usr/bin/tool-link"] != "usr/bin/tool" {
+		t.Fatalf("Hardlink was not preserved: %v", links)
+	}
+	if problems, err := built.CheckIntegrity(); err != nil || len(problems) != 0 {
+		t.Fatalf("Built package is inconsistent: %v %v", problems, err)
+	}
+}
@@ -0,0 +1,142 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+)
+
+// ComarDir is the directory within the package holding the COMAR scripts
+const ComarDir = "comar/"
+
+// ComarScript is a COMAR script in the package, along with its declaration
+// in the Provides of metadata.xml
+type ComarScript struct {
+	// Name of the script within ComarDir, such as "package.py"
+	Name string
+	// Model implemented by the script, such as "System.Package"
+	Model string
+	// Declared is set when the script is listed in Provides
+	Declared bool
+	// member is nil when the script is declared but missing
+	member *zip.File
+}
+
+// Present checks if the script is actually in the package
+func (s *ComarScript) Present() bool {
+	return s.member != nil
+}
+
+// Read returns the content of the script
+func (s *ComarScript) Read() ([]byte, error) {
+	if s.member == nil {
+		return nil, fmt.Errorf("'%s%s': %w", ComarDir, s.Name, fs.ErrNotExist)
+	}
+	in, err := s.member.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	return io.ReadAll(in)
+}
+
+// comarMembers finds every script in ComarDir, by name
+func (a *Archive) comarMembers() map[string]*zip.File {
+	members := make(map[string]*zip.File)
+	for _, f := range a.zipFile.File {
+		name := strings.TrimPrefix(f.Name, ComarDir)
+		if name == f.Name || name == "" || strings.HasSuffix(name, "/") {
+			continue
+		}
+		members[name] = f
+	}
+	return members
+}
+
+// ComarScripts lists every COMAR script that is either in the package or
+// declared in its Provides. Declared scripts come first in the order of
+// Provides, followed by any undeclared ones sorted by name. A script declared
+// more than once is listed once, with the model it was first declared for.
+func (a *Archive) ComarScripts() ([]*ComarScript, error) {
+	if a.Meta == nil {
+		if err := a.ReadMetadata(); err != nil {
+			return nil, err
+		}
+	}
+	members := a.comarMembers()
+	var scripts []*ComarScript
+	declared := make(map[string]bool)
+	for _, comar := range a.Meta.Package.Provides.COMAR {
+		if declared[comar.Script] {
+			continue
+		}
+		declared[comar.Script] = true
+		script := &ComarScript{Name: comar.Script, Model: comar.Value, Declared: true}
+		if member, ok := members[comar.Script]; ok {
+			script.member = member
+			delete(members, comar.Script)
+		}
+		scripts = append(scripts, script)
+	}
+	var undeclared []*ComarScript
+	for name, member := range members {
+		undeclared = append(undeclared, &ComarScript{Name: name, member: member})
+	}
+	sort.Slice(undeclared, func(i, j int) bool { return undeclared[i].Name < undeclared[j].Name })
+	return append(scripts, undeclared...), nil
+}
+
+// FindComarScript finds a single script by name, or returns nil if it is neither
+// in the package nor declared
+func (a *Archive) FindComarScript(name string) (*ComarScript, error) {
+	scripts, err := a.ComarScripts()
+	if err != nil {
+		return nil, err
+	}
+	for _, script := range scripts {
+		if script.Name == name {
+			return script, nil
+		}
+	}
+	return nil, nil
+}
+
+// CheckComar matches the scripts in the package against its Provides,
+// reporting any that are declared but missing as ProblemMissing, and any
+// that are present but not declared as ProblemUndeclared
+func (a *Archive) CheckComar() ([]*Problem, error) {
+	scripts, err := a.ComarScripts()
+	if err != nil {
+		return nil, err
+	}
+	var problems []*Problem
+	for _, script := range scripts {
+		path := ComarDir + script.Name
+		switch {
+		case !script.Present():
+			problems = append(problems, &Problem{Path: path, Kind: ProblemMissing, Expected: script.Model})
+		case !script.Declared:
+			problems = append(problems, &Problem{Path: path, Kind: ProblemUndeclared})
+		}
+	}
+	return problems, nil
+}
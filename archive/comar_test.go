@@ -0,0 +1,147 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"github.com/getsolus/libeopkg/shared"
+	"io/fs"
+	"testing"
+)
+
+// comarPackage is the nano package with the given Provides and scripts
+func comarPackage(t *testing.T, provides []shared.COMAR, scripts map[string]string) *Archive {
+	pkg, err := OpenAll(eopkgTestFile)
+	if err != nil {
+		t.Fatalf("Error opening valid .eopkg file: %v", err)
+	}
+	defer pkg.Close()
+	pkg.Meta.Package.Provides.COMAR = provides
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("metadata.xml")
+	if err != nil {
+		t.Fatalf("Failed to create metadata.xml: %v", err)
+	}
+	if err = pkg.Meta.Encode(w); err != nil {
+		t.Fatalf("Failed to write metadata.xml: %v", err)
+	}
+	err = copyMembers(zw, pkg.zipFile, func(f *zip.File) bool { return f.Name == "metadata.xml" }, nil)
+	if err != nil {
+		t.Fatalf("Failed to copy package: %v", err)
+	}
+	for name, body := range scripts {
+		if w, err = zw.Create(ComarDir + name); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+		w.Write([]byte(body))
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatalf("Failed to finish package: %v", err)
+	}
+	crafted, err := OpenBytes(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to open crafted package: %v", err)
+	}
+	return crafted
+}
+
+func TestComarScripts(t *testing.T) {
+	pkg := comarPackage(t, []shared.COMAR{
+		{Script: "package.py", Value: "System.Package"},
+		{Script: "service.py", Value: "System.Service"},
+	}, map[string]string{
+		"package.py": "def postInstall(): pass\n",
+		"zzz.py":     "def preRemove(): pass\n",
+		"manager.py": "def setState(): pass\n",
+	})
+	defer pkg.Close()
+	scripts, err := pkg.ComarScripts()
+	if err != nil {
+		t.Fatalf("Failed to list scripts: %v", err)
+	}
+	expected := []string{"package.py", "service.py", "manager.py", "zzz.py"}
+	if len(scripts) != len(expected) {
+		t.Fatalf("Expected %d scripts, got %d", len(expected), len(scripts))
+	}
+	for i, script := range scripts {
+		if script.Name != expected[i] {
+			t.Fatalf("Expected %s, got %s", expected[i], script.Name)
+		}
+	}
+	script, err := pkg.FindComarScript("package.py")
+	if err != nil || script == nil {
+		t.Fatalf("Failed to find package.py: %v", err)
+	}
+	if body, err := script.Read(); err != nil || string(body) != "def postInstall(): pass\n" {
+		t.Fatalf("Wrong content for package.py: %q %v", body, err)
+	}
+	if script.Model != "System.Package" || !script.Declared || !script.Present() {
+		t.Fatalf("package.py matched incorrectly: %+v", script)
+	}
+	if _, err = scripts[1].Read(); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Missing script should not be readable: %v", err)
+	}
+	problems, err := pkg.CheckComar()
+	if err != nil {
+		t.Fatalf("Failed to check scripts: %v", err)
+	}
+	kinds := []ProblemKind{ProblemMissing, ProblemUndeclared, ProblemUndeclared}
+	if len(problems) != len(kinds) {
+		t.Fatalf("Expected %d problems, got %v", len(kinds), problems)
+	}
+	for i, problem := range problems {
+		if problem.Kind != kinds[i] || problem.Path != ComarDir+expected[i+1] {
+			t.Fatalf("Unexpected problem: %v", problem)
+		}
+	}
+}
+
+func TestComarDuplicate(t *testing.T) {
+	pkg := comarPackage(t, []shared.COMAR{
+		{Script: "package.py", Value: "System.Package"},
+		{Script: "package.py", Value: "System.Package"},
+	}, map[string]string{"package.py": "def postInstall(): pass\n"})
+	defer pkg.Close()
+	scripts, err := pkg.ComarScripts()
+	if err != nil {
+		t.Fatalf("Failed to list scripts: %v", err)
+	}
+	if len(scripts) != 1 || !scripts[0].Present() {
+		t.Fatalf("Expected package.py once, got %v", scripts)
+	}
+	if problems, err := pkg.CheckComar(); err != nil || len(problems) != 0 {
+		t.Fatalf("Script declared twice should not be missing: %v %v", problems, err)
+	}
+}
+
+func TestComarNone(t *testing.T) {
+	pkg, err := Open(eopkgTestFile)
+	if err != nil {
+		t.Fatalf("Error opening valid .eopkg file: %v", err)
+	}
+	defer pkg.Close()
+	scripts, err := pkg.ComarScripts()
+	if err != nil || len(scripts) != 0 {
+		t.Fatalf("nano has no scripts, got %v: %v", scripts, err)
+	}
+	if problems, err := pkg.CheckComar(); err != nil || len(problems) != 0 {
+		t.Fatalf("nano should have no problems: %v %v", problems, err)
+	}
+}
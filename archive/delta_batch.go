@@ -0,0 +1,275 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"github.com/getsolus/libeopkg/shared"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrDuplicateDelta is returned for a source that is the same release as an
+// earlier source in the batch
+var ErrDuplicateDelta = errors.New("Delta from this release is already in the batch")
+
+// DeltaResult is the outcome of producing a delta from one older release
+type DeltaResult struct {
+	// Source is the path of the older package
+	Source string
+	// Path of the new delta package, empty when none was produced
+	Path string
+	// Err explains why no delta was produced, such as ErrMismatchedDelta,
+	// ErrDeltaPointless or a *DeltaTooLargeError
+	Err error
+}
+
+// BatchDeltaProducer creates deltas from any number of older releases to a
+// single target package. The target is opened once, and its payload is only
+// decompressed once no matter how many deltas are produced.
+type BatchDeltaProducer struct {
+	// Codec used for each delta's install tarball
+	Codec shared.Codec
+	// Compression settings for each delta's install tarball
+	Compression shared.CompressOptions
+	// Reproducible, when set, makes each delta depend only on its two packages
+	Reproducible *Reproducible
+	// Policy rejects deltas that save too little over the target package
+	Policy DeltaPolicy
+
+	target  *Archive
+	workDir string
+	dirs    []string
+}
+
+// NewBatchDeltaProducer will return a new batch producer for the target package
+func NewBatchDeltaProducer(workDir, target string) (b *BatchDeltaProducer, err error) {
+	b = &BatchDeltaProducer{
+		Codec:       shared.CodecXz,
+		Compression: shared.DefaultCompressOptions,
+		workDir:     workDir,
+	}
+	if b.target, err = OpenAll(target); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Close the BatchDeltaProducer, removing every delta it created
+func (b *BatchDeltaProducer) Close() error {
+	if b == nil {
+		return nil
+	}
+	b.target.Close()
+	var err error
+	for _, dir := range b.dirs {
+		if rerr := os.RemoveAll(dir); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// batchDelta is a delta in the middle of being written
+type batchDelta struct {
+	result   *DeltaResult
+	modified *Files
+	file     *os.File
+	zw       *zip.Writer
+	cw       io.WriteCloser
+	tw       *tar.Writer
+}
+
+// fail abandons the delta, recording why
+func (d *batchDelta) fail(err error) {
+	if d.cw != nil {
+		d.cw.Close()
+		d.cw = nil
+	}
+	d.file.Close()
+	os.Remove(d.result.Path)
+	d.result.Path, d.result.Err = "", err
+}
+
+// finish flushes the tarball and completes the delta package, so long as
+// the policy accepts it
+func (d *batchDelta) finish(policy DeltaPolicy, target string) {
+	err := d.tw.Close()
+	if err == nil {
+		err = d.cw.Close()
+	}
+	d.cw = nil
+	if err == nil {
+		err = d.zw.Close()
+	}
+	if err == nil {
+		err = d.file.Sync()
+	}
+	if err == nil {
+		err = policy.checkFiles(d.result.Path, target)
+	}
+	if err != nil {
+		d.fail(err)
+		return
+	}
+	d.result.Err = d.file.Close()
+}
+
+// batchWriter writes an entry into each of the deltas. Unlike an
+// io.MultiWriter, a delta that cannot be written is abandoned on its own and
+// skipped from then on, leaving the rest of the batch to carry on.
+type batchWriter []*batchDelta
+
+// Write writes p into every delta that has not failed
+func (w batchWriter) Write(p []byte) (int, error) {
+	for _, d := range w {
+		if d.result.Err != nil {
+			continue
+		}
+		if _, err := d.tw.Write(p); err != nil {
+			d.fail(err)
+		}
+	}
+	return len(p), nil
+}
+
+// prepare checks that a delta is possible from source, and starts writing it
+func (b *BatchDeltaProducer) prepare(source string, prefixes map[string]bool) (*batchDelta, error) {
+	old, err := OpenAll(source)
+	if err != nil {
+		return nil, err
+	}
+	defer old.Close()
+	if !old.IsDeltaPossible(b.target) {
+		return nil, ErrMismatchedDelta
+	}
+	diff := old.Files.Changes(b.target.Files)
+	if diff.Empty() {
+		return nil, ErrDeltaPointless
+	}
+	d := &batchDelta{
+		result:   &DeltaResult{Source: source},
+		modified: diff.Modified(),
+	}
+	// Same layout as DeltaProducer, for each source
+	prefix := old.Meta.Package.DeltaName(b.target.Meta.Package.GetRelease())
+	if prefixes[prefix] {
+		return nil, ErrDuplicateDelta
+	}
+	prefixes[prefix] = true
+	dir := filepath.Join(b.workDir, prefix)
+	if err = os.MkdirAll(dir, 00755); err != nil {
+		return nil, err
+	}
+	b.dirs = append(b.dirs, dir)
+	d.result.Path = filepath.Join(dir, prefix+".delta.eopkg")
+	if d.file, err = os.Create(d.result.Path); err != nil {
+		return nil, err
+	}
+	d.zw = zip.NewWriter(d.file)
+	err = copyMembers(d.zw, b.target.zipFile, skipDeltaMember, b.Reproducible)
+	if err != nil {
+		d.fail(err)
+		return nil, err
+	}
+	d.cw, err = b.Reproducible.createTarball(d.zw, b.Codec.TarballName(), b.Codec, b.Compression)
+	if err != nil {
+		d.fail(err)
+		return nil, err
+	}
+	d.tw = tar.NewWriter(d.cw)
+	return d, nil
+}
+
+// Create produces a delta from each of the sources to the target, skipping
+// any that cannot or need not be delta'd. There is one result per source, in
+// the same order.
+func (b *BatchDeltaProducer) Create(sources []string) []*DeltaResult {
+	results := make([]*DeltaResult, len(sources))
+	var deltas []*batchDelta
+	prefixes := make(map[string]bool)
+	for i, source := range sources {
+		d, err := b.prepare(source, prefixes)
+		if err != nil {
+			results[i] = &DeltaResult{Source: source, Err: err}
+			continue
+		}
+		results[i] = d.result
+		deltas = append(deltas, d)
+	}
+	if len(deltas) == 0 {
+		return results
+	}
+	if err := b.copy(deltas); err != nil {
+		for _, d := range deltas {
+			if d.result.Err == nil {
+				d.fail(err)
+			}
+		}
+		return results
+	}
+	for _, d := range deltas {
+		if d.result.Err == nil {
+			d.finish(b.Policy, b.target.Path)
+		}
+	}
+	return results
+}
+
+// copy reads the target payload once, writing each entry into every delta
+// that needs it
+func (b *BatchDeltaProducer) copy(deltas []*batchDelta) error {
+	f, err := b.target.openPayload()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		path := strings.TrimSuffix(header.Name, "/")
+		var writers batchWriter
+		for _, d := range deltas {
+			if d.result.Err != nil || !d.modified.HasFile(path) {
+				continue
+			}
+			h := *header
+			b.Reproducible.tarHeader(&h)
+			if err = d.tw.WriteHeader(&h); err != nil {
+				d.fail(err)
+				continue
+			}
+			writers = append(writers, d)
+		}
+		if len(writers) == 0 || (header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA) {
+			continue
+		}
+		if _, err = io.Copy(writers, tr); err != nil {
+			return err
+		}
+	}
+}
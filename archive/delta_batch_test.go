@@ -0,0 +1,119 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/getsolus/libeopkg/shared"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBatchDelta(t *testing.T) {
+	producer, err := NewBatchDeltaProducer(t.TempDir(), deltaNewPkg)
+	if err != nil {
+		t.Fatalf("Failed to create batch producer: %v", err)
+	}
+	defer producer.Close()
+	producer.Compression = shared.CompressOptions{Level: 0, Threads: 1}
+	results := producer.Create([]string{deltaOldPkg, deltaNewPkg, notAPkg, deltaOldPkg})
+	if len(results) != 4 {
+		t.Fatalf("Expected 4 results, got %d", len(results))
+	}
+	if !errors.Is(results[1].Err, ErrMismatchedDelta) || results[1].Path != "" {
+		t.Fatalf("Delta to the same release should be impossible: %v", results[1].Err)
+	}
+	if results[2].Err == nil || results[2].Path != "" {
+		t.Fatal("Delta from an invalid package should have failed")
+	}
+	if !errors.Is(results[3].Err, ErrDuplicateDelta) || results[3].Path != "" {
+		t.Fatalf("Repeated source should be rejected: %v", results[3].Err)
+	}
+	expected, err := OpenAll(deltaPkg)
+	if err != nil {
+		t.Fatalf("Error opening delta: %v", err)
+	}
+	defer expected.Close()
+	path := results[0].Path
+	if results[0].Err != nil {
+		t.Fatalf("Failed to produce delta: %v", results[0].Err)
+	}
+	if name := filepath.Base(path); name != filepath.Base(deltaPkg) {
+		t.Fatalf("Delta has the wrong name: %s", name)
+	}
+	delta, err := OpenAll(path)
+	if err != nil {
+		t.Fatalf("Failed to open delta: %v", err)
+	}
+	problems, err := delta.ComparePayload(expected)
+	delta.Close()
+	if err != nil || len(problems) != 0 {
+		t.Fatalf("Delta differs from the one made by eopkg: %v %v", problems, err)
+	}
+	if err = producer.Close(); err != nil {
+		t.Fatalf("Failed to close producer: %v", err)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("Close should remove the deltas")
+	}
+}
+
+func TestBatchWriterFailure(t *testing.T) {
+	dir := t.TempDir()
+	var deltas batchWriter
+	var bufs []*bytes.Buffer
+	// The first delta expects a shorter entry, so fails part way through
+	for i, size := range []int64{2, 5, 5} {
+		path := filepath.Join(dir, fmt.Sprint(i))
+		file, err := os.Create(path)
+		if err != nil {
+			t.Fatalf("Failed to create delta: %v", err)
+		}
+		buf := &bytes.Buffer{}
+		d := &batchDelta{result: &DeltaResult{Path: path}, file: file, tw: tar.NewWriter(buf)}
+		if err = d.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "file", Size: size}); err != nil {
+			t.Fatalf("Failed to write header: %v", err)
+		}
+		deltas = append(deltas, d)
+		bufs = append(bufs, buf)
+	}
+	if _, err := io.Copy(deltas, strings.NewReader("hello")); err != nil {
+		t.Fatalf("One failed delta should not stop the rest: %v", err)
+	}
+	if !errors.Is(deltas[0].result.Err, tar.ErrWriteTooLong) || deltas[0].result.Path != "" {
+		t.Fatalf("Delta should have failed: %v", deltas[0].result.Err)
+	}
+	for i, d := range deltas[1:] {
+		if d.result.Err != nil {
+			t.Fatalf("Delta should have succeeded: %v", d.result.Err)
+		}
+		if err := d.tw.Close(); err != nil {
+			t.Fatalf("Failed to finish tarball: %v", err)
+		}
+		header, err := tar.NewReader(bufs[i+1]).Next()
+		if err != nil || header.Size != 5 {
+			t.Fatalf("Delta is missing the entry: %v", err)
+		}
+		d.file.Close()
+	}
+}
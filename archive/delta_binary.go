@@ -0,0 +1,380 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrUnsupportedDelta is returned for a delta in a format that cannot be
+// handled, such as one newer than this library
+var ErrUnsupportedDelta = errors.New("Delta format is not supported")
+
+// DeltaFormat is the layout of a delta package
+type DeltaFormat int
+
+const (
+	// DeltaFull deltas hold every changed file whole in their install tarball,
+	// and can be installed by any version of eopkg
+	DeltaFull DeltaFormat = iota
+	// DeltaBinary deltas hold a binary patch in place of any changed regular
+	// file that it makes smaller. They carry a DeltaFormatFile, and have no
+	// install tarball, so older clients reject them before touching anything.
+	DeltaBinary
+)
+
+const (
+	// DeltaFormatFile marks a delta which is not a DeltaFull
+	DeltaFormatFile = "delta-format"
+	// DeltaTarballPrefix is the name of the tarball of a DeltaBinary, before
+	// the extension
+	DeltaTarballPrefix = "delta.tar"
+	// PatchRecord is the PAX record set on a patched entry of a DeltaBinary,
+	// holding the files.xml hash of the old file the patch applies to
+	PatchRecord = "LIBEOPKG.patch"
+)
+
+// binaryDeltaMarker is the content of DeltaFormatFile for a DeltaBinary
+const binaryDeltaMarker = "binary-1\n"
+
+// DeltaFormat checks the layout of a delta package. Any package without a
+// DeltaFormatFile is a DeltaFull.
+func (a *Archive) DeltaFormat() (DeltaFormat, error) {
+	f := a.FindFile(DeltaFormatFile)
+	if f == nil {
+		return DeltaFull, nil
+	}
+	in, err := f.Open()
+	if err != nil {
+		return DeltaFull, err
+	}
+	defer in.Close()
+	marker, err := io.ReadAll(io.LimitReader(in, 64))
+	if err != nil {
+		return DeltaFull, err
+	}
+	if string(marker) != binaryDeltaMarker {
+		return DeltaFull, fmt.Errorf("%w: '%s'", ErrUnsupportedDelta, strings.TrimSpace(string(marker)))
+	}
+	return DeltaBinary, nil
+}
+
+// openDeltaPayload opens the install tarball of a DeltaFull, or the patched
+// tarball of a DeltaBinary
+func (a *Archive) openDeltaPayload() (io.ReadCloser, error) {
+	format, err := a.DeltaFormat()
+	if err != nil {
+		return nil, err
+	}
+	if format == DeltaBinary {
+		return a.openTarball(DeltaTarballPrefix)
+	}
+	return a.openPayload()
+}
+
+// isRegular checks if a tar entry has content
+func isRegular(header *tar.Header) bool {
+	return header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA
+}
+
+// hashBytes hashes content the same way as files.xml
+func hashBytes(data []byte) string {
+	return fmt.Sprintf("%x", sha1.Sum(data))
+}
+
+// patchBasis is an old file that a patch can be made against
+type patchBasis struct {
+	// hash of the old file in files.xml
+	hash string
+	// path of the copy extracted from the old package
+	path string
+}
+
+// writeFormat marks the delta as a DeltaBinary
+func (dp *DeltaProducer) writeFormat(dst *zip.Writer) error {
+	w, err := dst.CreateHeader(dp.Reproducible.newZipHeader(DeltaFormatFile, zip.Store))
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, binaryDeltaMarker)
+	return err
+}
+
+// saveBases extracts the old copy of each changed file into dir, so that a
+// patch can be made against it. Any which do not match their hash in
+// files.xml are skipped, as the hash is how the patch finds its basis.
+func (dp *DeltaProducer) saveBases(changed []FileChange, dir string) (map[string]*patchBasis, error) {
+	wanted := make(map[string]string)
+	for _, c := range changed {
+		if c.Old.Hash != "" && c.New.Hash != "" {
+			wanted[c.Old.Path] = c.Old.Hash
+		}
+	}
+	bases := make(map[string]*patchBasis)
+	if len(wanted) == 0 {
+		return bases, nil
+	}
+	f, err := dp.left.openPayload()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return bases, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(header.Name, "/")
+		hash, ok := wanted[name]
+		if !ok || !isRegular(header) {
+			continue
+		}
+		basis := &patchBasis{hash: hash, path: filepath.Join(dir, fmt.Sprint(len(bases)))}
+		if ok, err = saveBasis(basis, tr); err != nil {
+			return nil, err
+		}
+		if ok {
+			bases[name] = basis
+		}
+	}
+}
+
+// saveBasis writes out a basis, keeping it only if it matches its hash
+func saveBasis(basis *patchBasis, src io.Reader) (bool, error) {
+	out, err := os.Create(basis.path)
+	if err != nil {
+		return false, err
+	}
+	h := sha1.New()
+	_, err = io.Copy(io.MultiWriter(out, h), src)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return false, err
+	}
+	if fmt.Sprintf("%x", h.Sum(nil)) != basis.hash {
+		return false, os.Remove(basis.path)
+	}
+	return true, nil
+}
+
+// copyPatched is Copy, except that each file with a basis is replaced by a
+// binary patch against it, whenever the patch is smaller. Both copies of the
+// file are held in memory while the patch is made.
+func (dp *DeltaProducer) copyPatched(dst *tar.Writer, modified *Files, bases map[string]*patchBasis) error {
+	f, err := dp.right.openPayload()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(header.Name, "/")
+		if !modified.HasFile(name) {
+			continue
+		}
+		dp.Reproducible.tarHeader(header)
+		basis, ok := bases[name]
+		if !ok || !isRegular(header) {
+			if err = dst.WriteHeader(header); err != nil {
+				return err
+			}
+			if isRegular(header) {
+				if _, err = io.Copy(dst, tr); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		old, err := os.ReadFile(basis.path)
+		if err != nil {
+			return err
+		}
+		if patch := MakePatch(old, data); len(patch) < len(data) {
+			records := map[string]string{PatchRecord: basis.hash}
+			for key, value := range header.PAXRecords {
+				records[key] = value
+			}
+			header.PAXRecords, header.Format = records, tar.FormatPAX
+			header.Size, data = int64(len(patch)), patch
+		}
+		if err = dst.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err = dst.Write(data); err != nil {
+			return err
+		}
+	}
+	return dst.Flush()
+}
+
+// patchBases finds the installed file each patch in the delta applies to,
+// before anything is changed. A patched file is its own basis when its hash
+// matches, and otherwise the basis must be a file that the delta leaves
+// untouched.
+func (d *DeltaInstaller) patchBases(delta *Archive) (map[string]string, error) {
+	f, err := delta.openDeltaPayload()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	included := make(map[string]bool)
+	patches := make(map[string]string)
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(header.Name, "/")
+		included[name] = true
+		if hash, ok := header.PAXRecords[PatchRecord]; ok {
+			patches[name] = hash
+		}
+	}
+	untouched := make(map[string]string)
+	for _, file := range d.Installed.File {
+		if _, ok := untouched[file.Hash]; !ok && file.Hash != "" && !included[file.Path] {
+			untouched[file.Hash] = file.Path
+		}
+	}
+	names := make([]string, 0, len(patches))
+	for name := range patches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	bases := make(map[string]string)
+	for _, name := range names {
+		hash := patches[name]
+		if file := d.Installed.Find(name); file != nil && file.Hash == hash {
+			bases[name] = name
+		} else if path, ok := untouched[hash]; ok {
+			bases[name] = path
+		} else {
+			return nil, fmt.Errorf("%w: no installed file to patch '%s' from", ErrDeltaMismatch, name)
+		}
+	}
+	return bases, nil
+}
+
+// applyPatch reads the basis from disk, and checks it is the file the patch
+// was made against before applying it
+func (d *DeltaInstaller) applyPatch(u *unpacker, basis, hash string, patch io.Reader) ([]byte, error) {
+	path, err := u.resolve(basis, "")
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%w: '%s' is not a regular file", ErrDeltaMismatch, basis)
+	}
+	old, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if hashBytes(old) != hash {
+		return nil, fmt.Errorf("%w: '%s' differs from the installed copy", ErrDeltaMismatch, basis)
+	}
+	data, err := io.ReadAll(patch)
+	if err != nil {
+		return nil, err
+	}
+	return ApplyPatch(old, data)
+}
+
+// unpackBinary is UnpackWith for a DeltaBinary, applying each patch to its
+// basis as the entry is extracted
+func (d *DeltaInstaller) unpackBinary(delta *Archive, bases map[string]string) error {
+	if err := delta.unpackMetadata(d.Meta, d.Root); err != nil {
+		return err
+	}
+	u, err := newUnpacker(d.Root, d.Options)
+	if err != nil {
+		return err
+	}
+	f, err := delta.openTarball(DeltaTarballPrefix)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		// Global PAX headers only describe the entries that follow
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		hash, ok := header.PAXRecords[PatchRecord]
+		if !ok {
+			if err = u.extract(header, tr); err != nil {
+				return err
+			}
+			continue
+		}
+		data, err := d.applyPatch(u, bases[strings.TrimSuffix(header.Name, "/")], hash, tr)
+		if err != nil {
+			return fmt.Errorf("'%s': %w", header.Name, err)
+		}
+		delete(header.PAXRecords, PatchRecord)
+		header.Size = int64(len(data))
+		if err = u.extract(header, bytes.NewReader(data)); err != nil {
+			return err
+		}
+	}
+	if err = u.finish(); err != nil || u.ownership == nil {
+		return err
+	}
+	return u.ownership.Save(d.Meta)
+}
@@ -0,0 +1,127 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"archive/tar"
+	"errors"
+	"github.com/getsolus/libeopkg/shared"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// binaryDelta produces a DeltaBinary between the two releases of nano
+func binaryDelta(t *testing.T) *Archive {
+	producer, err := NewDeltaProducer(t.TempDir(), deltaOldPkg, deltaNewPkg)
+	if err != nil {
+		t.Fatalf("Failed to create delta producer: %v", err)
+	}
+	t.Cleanup(func() { producer.Close() })
+	producer.Compression = shared.CompressOptions{Level: 0, Threads: 1}
+	producer.Format = DeltaBinary
+	path, err := producer.Create()
+	if err != nil {
+		t.Fatalf("Failed to produce binary delta: %v", err)
+	}
+	delta, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open binary delta: %v", err)
+	}
+	t.Cleanup(func() { delta.Close() })
+	return delta
+}
+
+// deltaPatches lists the patched entries of a delta by name
+func deltaPatches(t *testing.T, delta *Archive) map[string]string {
+	f, err := delta.openDeltaPayload()
+	if err != nil {
+		t.Fatalf("Failed to open delta payload: %v", err)
+	}
+	defer f.Close()
+	patches := make(map[string]string)
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return patches
+		}
+		if err != nil {
+			t.Fatalf("Failed to read delta payload: %v", err)
+		}
+		if hash, ok := header.PAXRecords[PatchRecord]; ok {
+			patches[header.Name] = hash
+		}
+	}
+}
+
+func TestBinaryDelta(t *testing.T) {
+	delta := binaryDelta(t)
+	if format, err := delta.DeltaFormat(); err != nil || format != DeltaBinary {
+		t.Fatalf("Delta is not marked as binary: %v %v", format, err)
+	}
+	// Clients that only know install.tar must refuse it
+	if err := delta.Unpack(t.TempDir(), t.TempDir()); !errors.Is(err, shared.ErrEopkgCorrupted) {
+		t.Fatalf("Binary delta should not unpack as a full one: %v", err)
+	}
+	if len(deltaPatches(t, delta)) == 0 {
+		t.Fatal("Binary delta has no patches")
+	}
+	installer, _ := installOld(t)
+	report, err := installer.Install(delta)
+	if err != nil {
+		t.Fatalf("Failed to install binary delta: %v", err)
+	}
+	if !report.OK() || len(report.Files) != len(delta.Files.File) {
+		t.Fatalf("Binary delta installed incorrectly: %s", report)
+	}
+}
+
+func TestBinaryDeltaMismatch(t *testing.T) {
+	delta := binaryDelta(t)
+	installer, _ := installOld(t)
+	var patched string
+	for name := range deltaPatches(t, delta) {
+		patched = name
+		break
+	}
+	// The file the patch was made against has been changed since
+	path := filepath.Join(installer.Root, patched)
+	if err := os.WriteFile(path, []byte("changed"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if _, err := installer.Install(delta); !errors.Is(err, ErrDeltaMismatch) {
+		t.Fatalf("Expected ErrDeltaMismatch, got: %v", err)
+	}
+	// Without any record of the basis, nothing is touched
+	for _, f := range installer.Installed.File {
+		if f.Path == patched {
+			f.Hash = "0000000000000000000000000000000000000000"
+		}
+	}
+	os.Remove(filepath.Join(installer.Meta, "metadata.xml"))
+	if _, err := installer.Install(delta); !errors.Is(err, ErrDeltaMismatch) {
+		t.Fatalf("Expected ErrDeltaMismatch, got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(installer.Meta, "metadata.xml")); !os.IsNotExist(err) {
+		t.Fatal("Delta was installed without a basis for every patch")
+	}
+	if err := NewReconstructor(delta, delta).Write(filepath.Join(t.TempDir(), "rebuilt.eopkg")); !errors.Is(err, ErrUnsupportedDelta) {
+		t.Fatalf("Reconstructor should reject binary deltas: %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// ErrDeltaMismatch is returned when a delta was not made from the installed
+// release of the package
+var ErrDeltaMismatch = errors.New("Delta does not apply to the installed package")
+
+// DeltaInstaller applies a delta package over an installed copy of the
+// release it was made from, leaving the new release installed
+type DeltaInstaller struct {
+	// Installed is the files.xml of the release currently installed
+	Installed *Files
+	// Root is where the files are installed
+	Root string
+	// Meta is where 'files.xml' and 'metadata.xml' are installed
+	Meta string
+	// Options are used to unpack the changed files
+	Options UnpackOptions
+}
+
+// NewDeltaInstaller creates a DeltaInstaller for the package installed in root
+func NewDeltaInstaller(installed *Files, metaPath, root string) *DeltaInstaller {
+	return &DeltaInstaller{
+		Installed: installed,
+		Root:      root,
+		Meta:      metaPath,
+	}
+}
+
+// deltaPaths lists every entry in the payload of the delta
+func deltaPaths(delta *Archive) (map[string]bool, error) {
+	f, err := delta.openDeltaPayload()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	paths := make(map[string]bool)
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return paths, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		paths[strings.TrimSuffix(header.Name, "/")] = true
+	}
+}
+
+// plan checks that every file left out of the delta is already installed as
+// the new release expects, and finds the installed files that are no longer
+// listed
+func (d *DeltaInstaller) plan(delta *Archive) (removed []*File, err error) {
+	included, err := deltaPaths(delta)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range delta.Files.File {
+		if included[f.Path] {
+			continue
+		}
+		if old := d.Installed.Find(f.Path); old == nil || !old.Equal(f) {
+			return nil, fmt.Errorf("%w: '%s' is not in the delta, and differs from the installed copy", ErrDeltaMismatch, f.Path)
+		}
+	}
+	removed = d.Installed.Changes(delta.Files).Removed
+	// Deepest first, so directories are emptied before they are removed
+	sort.Slice(removed, func(i, j int) bool { return removed[i].Path > removed[j].Path })
+	return removed, nil
+}
+
+// remove deletes files which are no longer part of the package. Directories
+// are only removed once empty.
+func (d *DeltaInstaller) remove(removed []*File) error {
+	u, err := newUnpacker(d.Root, d.Options)
+	if err != nil {
+		return err
+	}
+	for _, f := range removed {
+		dst, err := u.resolve(f.Path, "")
+		if err != nil {
+			return err
+		}
+		if err = os.Remove(dst); err == nil || os.IsNotExist(err) {
+			continue
+		}
+		if errors.Is(err, syscall.ENOTEMPTY) || errors.Is(err, syscall.EEXIST) {
+			// Still in use by another package
+			continue
+		}
+		return err
+	}
+	return nil
+}
+
+// mergeOwnership keeps the sidecar entries of every unchanged file, as the
+// delta only records the files it contains
+func (d *DeltaInstaller) mergeOwnership(previous *Ownership, delta *Archive) error {
+	current, err := ReadOwnership(d.Meta)
+	if err != nil {
+		return err
+	}
+	changed := current.byPath()
+	old := previous.byPath()
+	merged := &Ownership{}
+	for _, f := range delta.Files.File {
+		if entry, ok := changed[f.Path]; ok {
+			merged.Entry = append(merged.Entry, entry)
+		} else if entry, ok = old[f.Path]; ok {
+			merged.Entry = append(merged.Entry, entry)
+		}
+	}
+	return merged.Save(d.Meta)
+}
+
+// Install writes every changed file from the delta, removes every file the
+// new release no longer lists, and then verifies the whole tree against the
+// new files.xml. The report is returned along with its first problem, if any.
+//
+// Nothing is touched if the delta was made from a different release. Each
+// patch in a DeltaBinary is applied to the installed file with the hash it
+// was made against.
+func (d *DeltaInstaller) Install(delta *Archive) (*Report, error) {
+	if err := delta.ReadAll(); err != nil {
+		return nil, err
+	}
+	format, err := delta.DeltaFormat()
+	if err != nil {
+		return nil, err
+	}
+	removed, err := d.plan(delta)
+	if err != nil {
+		return nil, err
+	}
+	var bases map[string]string
+	if format == DeltaBinary {
+		if bases, err = d.patchBases(delta); err != nil {
+			return nil, err
+		}
+	}
+	var previous *Ownership
+	if d.Options.sidecar() {
+		if previous, err = ReadOwnership(d.Meta); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if format == DeltaBinary {
+		err = d.unpackBinary(delta, bases)
+	} else {
+		err = delta.UnpackWith(d.Meta, d.Root, d.Options)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = d.remove(removed); err != nil {
+		return nil, err
+	}
+	opts := VerifyOptions{}
+	if d.Options.sidecar() {
+		if err = d.mergeOwnership(previous, delta); err != nil {
+			return nil, err
+		}
+		if opts.Ownership, err = ReadOwnership(d.Meta); err != nil {
+			return nil, err
+		}
+	}
+	report, err := delta.CheckWith(d.Root, opts)
+	if err != nil {
+		return nil, err
+	}
+	return report, report.Err()
+}
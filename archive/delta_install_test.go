@@ -0,0 +1,96 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"encoding/xml"
+	"errors"
+	"github.com/getsolus/libeopkg/shared"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const deltaPkg = "../testdata/delta/nano-117-118-1-x86_64.delta.eopkg"
+
+// installOld installs the previous release of nano into a fresh root
+func installOld(t *testing.T) (installer *DeltaInstaller, delta *Archive) {
+	old, err := OpenAll(deltaOldPkg)
+	if err != nil {
+		t.Fatalf("Error opening valid .eopkg file: %v", err)
+	}
+	defer old.Close()
+	dir := t.TempDir()
+	installer = NewDeltaInstaller(old.Files, filepath.Join(dir, "meta"), filepath.Join(dir, "root"))
+	if err = old.Unpack(installer.Meta, installer.Root); err != nil {
+		t.Fatalf("Could not unpack .eopkg file: %v", err)
+	}
+	if delta, err = Open(deltaPkg); err != nil {
+		t.Fatalf("Error opening delta: %v", err)
+	}
+	t.Cleanup(func() { delta.Close() })
+	return
+}
+
+func TestDeltaInstall(t *testing.T) {
+	installer, delta := installOld(t)
+	// A file from the old release that the new one no longer has
+	stale := filepath.Join(installer.Root, "usr/share/nano/stale.nanorc")
+	if err := os.WriteFile(stale, []byte("stale"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	installer.Installed.File = append(installer.Installed.File, &File{Path: "usr/share/nano/stale.nanorc", Type: shared.FileData})
+	report, err := installer.Install(delta)
+	if err != nil {
+		t.Fatalf("Failed to install delta: %v", err)
+	}
+	if !report.OK() || len(report.Files) != len(delta.Files.File) {
+		t.Fatalf("Delta installed incorrectly: %s", report)
+	}
+	if _, err = os.Lstat(stale); !os.IsNotExist(err) {
+		t.Fatalf("Unlisted file was not removed: %v", err)
+	}
+	meta, err := os.ReadFile(filepath.Join(installer.Meta, "metadata.xml"))
+	if err != nil {
+		t.Fatalf("Failed to read installed metadata: %v", err)
+	}
+	installed := &Metadata{}
+	if err = xml.Unmarshal(meta, installed); err != nil || installed.Package.GetRelease() != 118 {
+		t.Fatalf("New metadata was not installed: %v", err)
+	}
+}
+
+func TestDeltaInstallMismatch(t *testing.T) {
+	installer, delta := installOld(t)
+	// Pretend an unchanged file was different in the installed release
+	for _, f := range installer.Installed.File {
+		if f.Path == "usr/share/nano/c.nanorc" {
+			f.Hash = "0000000000000000000000000000000000000000"
+		}
+	}
+	before, err := os.ReadFile(filepath.Join(installer.Root, "usr/bin/nano"))
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if _, err = installer.Install(delta); !errors.Is(err, ErrDeltaMismatch) {
+		t.Fatalf("Expected ErrDeltaMismatch, got %v", err)
+	}
+	after, err := os.ReadFile(filepath.Join(installer.Root, "usr/bin/nano"))
+	if err != nil || string(after) != string(before) {
+		t.Fatalf("Root was modified by a delta that does not apply: %v", err)
+	}
+}
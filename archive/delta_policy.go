@@ -0,0 +1,102 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrDeltaTooLarge is returned when a delta saves too little over the full
+// package to be worth publishing. The error is always a *DeltaTooLargeError.
+var ErrDeltaTooLarge = errors.New("Delta is too large to be worth publishing")
+
+// DeltaPolicy decides whether a delta is worth publishing, given its size and
+// that of the full package. The zero DeltaPolicy accepts every delta.
+type DeltaPolicy struct {
+	// MaxPercent is the largest a delta may be, as a percentage of the full
+	// package. Zero means no limit.
+	MaxPercent float64
+	// MinSaved is the fewest bytes a delta must save over the full package.
+	// Zero means no limit.
+	MinSaved int64
+}
+
+// DeltaTooLargeError records why a delta was rejected by a DeltaPolicy
+type DeltaTooLargeError struct {
+	// DeltaSize is the size of the delta package in bytes
+	DeltaSize int64
+	// FullSize is the size of the full package in bytes
+	FullSize int64
+	// Policy that rejected the delta
+	Policy DeltaPolicy
+}
+
+// Saved is the number of bytes the delta would have saved, which is negative
+// when it is larger than the full package
+func (e *DeltaTooLargeError) Saved() int64 {
+	return e.FullSize - e.DeltaSize
+}
+
+// Percent is the size of the delta as a percentage of the full package
+func (e *DeltaTooLargeError) Percent() float64 {
+	if e.FullSize == 0 {
+		return 100
+	}
+	return float64(e.DeltaSize) * 100 / float64(e.FullSize)
+}
+
+// Error describes the sizes involved
+func (e *DeltaTooLargeError) Error() string {
+	return fmt.Sprintf("%s: %d bytes is %.1f%% of the %d byte package, saving %d bytes",
+		ErrDeltaTooLarge, e.DeltaSize, e.Percent(), e.FullSize, e.Saved())
+}
+
+// Unwrap allows errors.Is(err, ErrDeltaTooLarge)
+func (e *DeltaTooLargeError) Unwrap() error {
+	return ErrDeltaTooLarge
+}
+
+// Check returns a *DeltaTooLargeError if a delta of deltaSize bytes does not
+// save enough over a full package of fullSize bytes
+func (p DeltaPolicy) Check(deltaSize, fullSize int64) error {
+	e := &DeltaTooLargeError{DeltaSize: deltaSize, FullSize: fullSize, Policy: p}
+	if p.MaxPercent > 0 && e.Percent() > p.MaxPercent {
+		return e
+	}
+	if p.MinSaved > 0 && e.Saved() < p.MinSaved {
+		return e
+	}
+	return nil
+}
+
+// checkFiles applies the policy to a delta and full package on disk
+func (p DeltaPolicy) checkFiles(delta, full string) error {
+	if p == (DeltaPolicy{}) {
+		return nil
+	}
+	d, err := os.Stat(delta)
+	if err != nil {
+		return err
+	}
+	f, err := os.Stat(full)
+	if err != nil {
+		return err
+	}
+	return p.Check(d.Size(), f.Size())
+}
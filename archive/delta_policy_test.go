@@ -0,0 +1,92 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"errors"
+	"github.com/getsolus/libeopkg/shared"
+	"os"
+	"testing"
+)
+
+func TestDeltaPolicyCheck(t *testing.T) {
+	if err := (DeltaPolicy{}).Check(200, 100); err != nil {
+		t.Fatalf("Zero policy should accept any delta: %v", err)
+	}
+	policy := DeltaPolicy{MaxPercent: 50, MinSaved: 1000}
+	if err := policy.Check(400, 2000); err != nil {
+		t.Fatalf("Delta should have been accepted: %v", err)
+	}
+	err := policy.Check(1200, 2000)
+	var tooLarge *DeltaTooLargeError
+	if !errors.As(err, &tooLarge) || !errors.Is(err, ErrDeltaTooLarge) {
+		t.Fatalf("Expected DeltaTooLargeError, got: %v", err)
+	}
+	if tooLarge.DeltaSize != 1200 || tooLarge.FullSize != 2000 || tooLarge.Saved() != 800 || tooLarge.Percent() != 60 {
+		t.Fatalf("Wrong sizes recorded: %+v", tooLarge)
+	}
+	if err = policy.Check(900, 1800); !errors.Is(err, ErrDeltaTooLarge) {
+		t.Fatalf("Delta saving under MinSaved should be rejected: %v", err)
+	}
+}
+
+func TestDeltaPolicy(t *testing.T) {
+	producer, err := NewDeltaProducer(t.TempDir(), deltaOldPkg, deltaNewPkg)
+	if err != nil {
+		t.Fatalf("Failed to create delta producer: %v", err)
+	}
+	defer producer.Close()
+	producer.Compression = shared.CompressOptions{Level: 0, Threads: 1}
+	producer.Policy = DeltaPolicy{MaxPercent: 10}
+	path, err := producer.Create()
+	var tooLarge *DeltaTooLargeError
+	if !errors.As(err, &tooLarge) || path != "" {
+		t.Fatalf("Delta over 10%% should be rejected: %v", err)
+	}
+	full, err := os.Stat(deltaNewPkg)
+	if err != nil {
+		t.Fatalf("Failed to stat package: %v", err)
+	}
+	if tooLarge.FullSize != full.Size() || tooLarge.DeltaSize <= 0 {
+		t.Fatalf("Wrong sizes recorded: %+v", tooLarge)
+	}
+	entries, err := os.ReadDir(producer.workDir)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("Rejected delta should be removed: %v %v", entries, err)
+	}
+	producer.Policy = DeltaPolicy{MaxPercent: 60, MinSaved: 1024}
+	if path, err = producer.Create(); err != nil {
+		t.Fatalf("Delta should have been accepted: %v", err)
+	}
+	if _, err = os.Stat(path); err != nil {
+		t.Fatalf("Accepted delta is missing: %v", err)
+	}
+}
+
+func TestBatchDeltaPolicy(t *testing.T) {
+	producer, err := NewBatchDeltaProducer(t.TempDir(), deltaNewPkg)
+	if err != nil {
+		t.Fatalf("Failed to create batch producer: %v", err)
+	}
+	defer producer.Close()
+	producer.Compression = shared.CompressOptions{Level: 0, Threads: 1}
+	producer.Policy = DeltaPolicy{MinSaved: 1 << 30}
+	results := producer.Create([]string{deltaOldPkg})
+	if !errors.Is(results[0].Err, ErrDeltaTooLarge) || results[0].Path != "" {
+		t.Fatalf("Delta saving under 1GiB should be rejected: %v", results[0].Err)
+	}
+}
@@ -20,9 +20,7 @@ import (
 	"archive/tar"
 	"archive/zip"
 	"errors"
-	"fmt"
 	"github.com/getsolus/libeopkg/shared"
-	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -41,11 +39,21 @@ var (
 // DeltaProducer is responsible for taking two eopkg packages and spitting out
 // a delta package for them, containing only the new files.
 type DeltaProducer struct {
+	// Codec used for the delta's install tarball
+	Codec shared.Codec
+	// Compression settings for the delta's install tarball
+	Compression shared.CompressOptions
+	// Reproducible, when set, makes the delta depend only on the two packages
+	Reproducible *Reproducible
+	// Policy rejects deltas that save too little over the new package
+	Policy DeltaPolicy
+	// Format of the delta, which is DeltaFull unless set otherwise
+	Format DeltaFormat
+
 	left    *Archive
 	right   *Archive
 	prefix  string
 	workDir string
-	diffMap map[string]int
 }
 
 // NewDeltaProducer will return a new delta producer for the given input packages
@@ -53,7 +61,8 @@ type DeltaProducer struct {
 func NewDeltaProducer(workDir string, left string, right string) (dp *DeltaProducer, err error) {
 	// Init a new DeltaProducer
 	dp = &DeltaProducer{
-		diffMap: make(map[string]int),
+		Codec:       shared.CodecXz,
+		Compression: shared.DefaultCompressOptions,
 	}
 	// Open the previous release
 	dp.left, err = OpenAll(left)
@@ -100,187 +109,112 @@ func (dp *DeltaProducer) Close() error {
 	return nil
 }
 
-// produceTarball copies all of the files into the tarball and compresses it
-func (dp *DeltaProducer) produceTarball() (filename string, err error) {
-	// Convert file lists to maps
-	modified, removed := dp.left.Diff(dp.right)
+// Copy will iterate over the contents of the existing install tarball for the new package,
+// and only include the files that aren't hash-matched in the old files.xml
+func (dp *DeltaProducer) Copy(dst *tar.Writer, modified *Files) error {
+	return copyPayload(dst, dp.right, dp.Reproducible, func(name string, _ *tar.Header) bool {
+		return modified.HasFile(name)
+	})
+}
 
-	// All the same files
-	if len(modified.File) == 0 && len(removed.File) == 0 {
-		err = ErrDeltaPointless
-		return
-	}
-	// Open output file to write our tarfile.
-	installTar := filepath.Join(dp.workDir, "delta-install.tar")
-	outF, err := os.Create(installTar)
-	if err != nil {
-		return
-	}
-	tw := tar.NewWriter(outF)
-	// Copy the delta files
-	if err = dp.Copy(tw, modified); err != nil {
-		outF.Close()
-		return
-	}
-	// Save the contents and close file
-	tw.Close()
-	outF.Close()
-	// Compress the tarball
-	filename = fmt.Sprintf("%s.xz", installTar)
-	println(filename)
-	err = shared.XzFile(installTar, false)
-	return
+// copyZipModified will iterate the central zip directory and skip the
+// install tarball and any signature, whilst copying everything else into
+// the new zip
+func (dp *DeltaProducer) copyZipModified(dst *zip.Writer) error {
+	return copyMembers(dst, dp.right.zipFile, skipDeltaMember, dp.Reproducible)
 }
 
-// Copy will iterate over the contents of the existing install.tar.xz for the new package,
-// and only include the files that aren't hash-matched in the old files.xml
-func (dp *DeltaProducer) Copy(dst *tar.Writer, modified *Files) error {
-	// Unpack the existing tarball from zip container and decompressing it
-	if err := dp.right.ExtractTarball(dp.workDir); err != nil {
-		return err
+// skipDeltaMember drops any kind of install.tar, which the delta replaces,
+// and the signature of the full package, which can never match the delta
+func skipDeltaMember(f *zip.File) bool {
+	return strings.HasPrefix(f.Name, shared.TarballPrefix) || f.Name == SignatureFile
+}
+
+// Create will attempt to produce a delta between the 2 eopkg files
+// This will be performed in temporary storage so must then be copied into
+// the final resting location, and unlinked, before it can be used.
+//
+// The delta is streamed straight from the new package into the zip, so the
+// only file written is the delta itself. If the Policy rejects the finished
+// delta, it is removed and a *DeltaTooLargeError is returned.
+func (dp *DeltaProducer) Create() (filename string, err error) {
+	if dp.Format != DeltaFull && dp.Format != DeltaBinary {
+		return "", ErrUnsupportedDelta
 	}
-	// Open the tarball
-	srcTar := filepath.Join(dp.workDir, "delta-install.tar")
-	f, err := os.Open(srcTar)
-	if err != nil {
-		return err
+	diff := dp.left.Files.Changes(dp.right.Files)
+	// All the same files
+	if diff.Empty() {
+		return "", ErrDeltaPointless
 	}
-	defer f.Close()
-	src := tar.NewReader(f)
-	// Iterate over tarball contents
-	header, err := src.Next()
-	for err != nil && header != nil {
-		// Ensure that we compare things in the same way
-		path := strings.TrimSuffix(header.Name, "/")
-		// Skip anything not in modifed
-		if !modified.HasFile(path) {
-			continue
-		}
-		// Create new entry in the output tarball
-		if err = dst.WriteHeader(header); err != nil {
-			return err
-		}
-		// Copy file from package to delta
-		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
-			if _, err = io.Copy(dst, src); err != nil {
-				return err
-			}
-		}
-		header, err = src.Next()
+	filename = filepath.Join(dp.workDir, dp.prefix+".delta.eopkg")
+	dst, err := os.Create(filename)
+	if err != nil {
+		return "", err
 	}
-	if err == io.EOF {
-		err = nil
+	defer dst.Close()
+	err = dp.write(dst, diff)
+	if err == nil {
+		err = dp.Policy.checkFiles(filename, dp.right.Path)
 	}
 	if err != nil {
-		return err
+		// Remove the incomplete or unwanted delta
+		_ = os.Remove(filename)
+		return "", err
 	}
-	// flush contents to disk
-	return dst.Flush()
+	return filename, nil
 }
 
-// copyZipModified will iterate the central zip directory and skip only the
-// install.tar.xz files, whilst copying everything else into the new zip
-func (dp *DeltaProducer) copyZipModified(dst *zip.Writer) error {
-	// iterate over zip contents
-	for _, src := range dp.right.zipFile.File {
-		// Skip any kind of install.tar internally
-		if strings.HasPrefix(src.Name, "install.tar") {
-			continue
-		}
-		// Open the file
-		srcFile, err := src.Open()
+// write assembles the delta, compressing the modified files straight into
+// its install tarball
+func (dp *DeltaProducer) write(dst *os.File, diff *FilesDiff) error {
+	modified := diff.Modified()
+	zipFile := zip.NewWriter(dst)
+	name := dp.Codec.TarballName()
+	var bases map[string]*patchBasis
+	if dp.Format == DeltaBinary {
+		// Old copies of the changed files, to make the patches against
+		dir, err := os.MkdirTemp(dp.workDir, ".bases-")
 		if err != nil {
 			return err
 		}
-		// Duplicate the header
-		dstFile, err := dst.CreateHeader(&src.FileHeader)
-		if err != nil {
-			srcFile.Close()
+		defer os.RemoveAll(dir)
+		if bases, err = dp.saveBases(diff.Changed, dir); err != nil {
 			return err
 		}
-		// Copy the File member across (it implements FileHeader)
-		if _, err = io.Copy(dstFile, srcFile); err != nil {
-			srcFile.Close()
+		if err = dp.writeFormat(zipFile); err != nil {
 			return err
 		}
-		// Close the File
-		srcFile.Close() // be really sure we close it..
+		name = DeltaTarballPrefix + dp.Codec.Extension()
 	}
-	// flush to disk
-	return dst.Flush()
-}
-
-// saveTarball adds the new tarball to the package
-func (dp *DeltaProducer) saveTarball(zipFile *zip.Writer, xzPath string) error {
-	// Open the tarball file
-	src, err := os.Open(xzPath)
-	if err != nil {
+	// Copy the other files
+	if err := dp.copyZipModified(zipFile); err != nil {
 		return err
 	}
-	defer src.Close()
-	// Stat for header
-	fst, err := src.Stat()
+	xw, err := dp.Reproducible.createTarball(zipFile, name, dp.Codec, dp.Compression)
 	if err != nil {
 		return err
 	}
-	// Create a Zip file header
-	fh, err := zip.FileInfoHeader(fst)
-	if err != nil {
-		return err
+	tw := tar.NewWriter(xw)
+	// Copy the delta files
+	if dp.Format == DeltaBinary {
+		err = dp.copyPatched(tw, modified, bases)
+	} else {
+		err = dp.Copy(tw, modified)
 	}
-	// Ensure it's always the right name.
-	fh.Name = "install.tar.xz"
-	// Write the header
-	dst, err := zipFile.CreateHeader(fh)
 	if err != nil {
+		xw.Close()
 		return err
 	}
-	// Copy the tarball contents
-	if _, err = io.Copy(dst, src); err != nil {
+	// Save the contents and flush the compressor
+	if err = tw.Close(); err != nil {
+		xw.Close()
 		return err
 	}
-	// flush to disk
-	return zipFile.Flush()
-}
-
-// Create will attempt to produce a delta between the 2 eopkg files
-// This will be performed in temporary storage so must then be copied into
-// the final resting location, and unlinked, before it can be used.
-func (dp *DeltaProducer) Create() (filename string, err error) {
-	// Generate the tarball
-	xzPath, err := dp.produceTarball()
-	if err != nil {
-		_ = os.Remove(xzPath)
-		return
-	}
-	// Open the Zip file
-	filename = filepath.Join(dp.workDir, dp.prefix+".delta.eopkg")
-	dst, err := os.Create(filename)
-	if err != nil {
-		dp.cleanup(xzPath, filename)
-		return
-	}
-	defer dst.Close()
-	zipFile := zip.NewWriter(dst)
-	// Copy the other files
-	if err = dp.copyZipModified(zipFile); err != nil {
-		dp.cleanup(xzPath, filename)
-		zipFile.Close()
-		return
+	if err = xw.Close(); err != nil {
+		return err
 	}
-	// Copy the tarball
-	if err = dp.saveTarball(zipFile, xzPath); err != nil {
-		dp.cleanup(xzPath, filename)
-		zipFile.Close()
-		return
+	if err = zipFile.Close(); err != nil {
+		return err
 	}
-	// Close the zip file
-	err = zipFile.Close()
-	return
-}
-
-// cleanup removes imcomplete deta files
-func (dp *DeltaProducer) cleanup(xzPath, zipPath string) {
-	_ = os.Remove(xzPath)
-	_ = os.Remove(zipPath)
+	return dst.Sync()
 }
@@ -17,7 +17,10 @@
 package archive
 
 import (
+	"archive/zip"
+	"github.com/getsolus/libeopkg/shared"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -105,3 +108,64 @@ func TestBasicDeltaImpossibleGreater(t *testing.T) {
 	}
 	producer.Close()
 }
+
+func TestDeltaCodec(t *testing.T) {
+	producer, err := NewDeltaProducer(t.TempDir(), deltaOldPkg, deltaNewPkg)
+	if err != nil {
+		t.Fatalf("Failed to create delta producer for existing pkgs: %v", err)
+	}
+	defer producer.Close()
+	producer.Codec = shared.CodecZstd
+	path, err := producer.Create()
+	if err != nil {
+		t.Fatalf("Failed to produce delta packages: %v", err)
+	}
+	pkg, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open our delta package: %v", err)
+	}
+	defer pkg.Close()
+	if pkg.FindFile("install.tar.zst") == nil {
+		t.Fatalf("Delta should have a zstd payload")
+	}
+	if codec, err := pkg.PayloadCodec(); err != nil || codec != shared.CodecZstd {
+		t.Fatalf("Expected zstd payload, got %s: %v", codec, err)
+	}
+}
+
+func TestDeltaStreaming(t *testing.T) {
+	producer, err := NewDeltaProducer(t.TempDir(), deltaOldPkg, deltaNewPkg)
+	if err != nil {
+		t.Fatalf("Failed to create delta producer for existing pkgs: %v", err)
+	}
+	defer producer.Close()
+	path, err := producer.Create()
+	if err != nil {
+		t.Fatalf("Failed to produce delta packages: %v", err)
+	}
+	// Nothing but the delta itself should have been written
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("Failed to list work directory: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != filepath.Base(path) {
+		t.Fatalf("Temporary files left in the work directory: %v", entries)
+	}
+	pkg, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open our delta package: %v", err)
+	}
+	defer pkg.Close()
+	member := pkg.FindFile(shared.CodecXz.TarballName())
+	if member == nil || member.Method != zip.Store {
+		t.Fatal("Delta payload should be stored without further compression")
+	}
+	expected, err := Open(deltaPkg)
+	if err != nil {
+		t.Fatalf("Error opening delta: %v", err)
+	}
+	defer expected.Close()
+	if problems, err := pkg.ComparePayload(expected); err != nil || len(problems) != 0 {
+		t.Fatalf("Delta differs from the one made by eopkg: %v %v", problems, err)
+	}
+}
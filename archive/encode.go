@@ -0,0 +1,288 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"bufio"
+	"github.com/getsolus/libeopkg/shared"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// xmlEscaper escapes text and attributes the same way as eopkg, which unlike
+// encoding/xml leaves newlines alone and uses named entities for quotes
+var xmlEscaper = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	"'", "&apos;",
+	`"`, "&quot;",
+)
+
+// xmlAttr is a single attribute of an element
+type xmlAttr struct {
+	name, value string
+}
+
+// xmlWriter writes XML laid out exactly as eopkg does: no declaration, four
+// spaces of indentation, and no newline after the root element
+type xmlWriter struct {
+	w     *bufio.Writer
+	depth int
+	err   error
+}
+
+// newXMLWriter creates a writer for a new document
+func newXMLWriter(w io.Writer) *xmlWriter {
+	return &xmlWriter{w: bufio.NewWriter(w)}
+}
+
+// write outputs raw XML, remembering the first error
+func (x *xmlWriter) write(s string) {
+	if x.err == nil {
+		_, x.err = x.w.WriteString(s)
+	}
+}
+
+// startTag begins a new line at the current depth with the opening tag
+func (x *xmlWriter) startTag(name string, attrs []xmlAttr) {
+	if x.depth > 0 {
+		x.write("\n" + strings.Repeat("    ", x.depth))
+	}
+	x.write("<" + name)
+	for _, attr := range attrs {
+		x.write(" " + attr.name + `="` + xmlEscaper.Replace(attr.value) + `"`)
+	}
+	x.write(">")
+}
+
+// open starts an element with children
+func (x *xmlWriter) open(name string, attrs ...xmlAttr) {
+	x.startTag(name, attrs)
+	x.depth++
+}
+
+// close ends an element with children
+func (x *xmlWriter) close(name string) {
+	x.depth--
+	if x.depth > 0 {
+		x.write("\n" + strings.Repeat("    ", x.depth))
+	} else {
+		x.write("\n")
+	}
+	x.write("</" + name + ">")
+}
+
+// raw writes an element whose value is already escaped
+func (x *xmlWriter) raw(name, value string, attrs ...xmlAttr) {
+	x.startTag(name, attrs)
+	x.write(value + "</" + name + ">")
+}
+
+// text writes an element containing only text
+func (x *xmlWriter) text(name, value string, attrs ...xmlAttr) {
+	x.raw(name, xmlEscaper.Replace(value), attrs...)
+}
+
+// optional writes a text element, unless it is empty
+func (x *xmlWriter) optional(name, value string) {
+	if value != "" {
+		x.text(name, value)
+	}
+}
+
+// int writes an element containing a number
+func (x *xmlWriter) int(name string, value int64) {
+	x.raw(name, strconv.FormatInt(value, 10))
+}
+
+// flush finishes the document, returning the first error
+func (x *xmlWriter) flush() error {
+	if x.err != nil {
+		return x.err
+	}
+	return x.w.Flush()
+}
+
+// localised writes a translated field, once per language
+func (x *xmlWriter) localised(name string, fields shared.LocalisedFields) {
+	for _, field := range fields {
+		if field.Lang == "" {
+			x.text(name, field.Value)
+		} else {
+			x.text(name, field.Value, xmlAttr{"xml:lang", field.Lang})
+		}
+	}
+}
+
+// source writes a <Source> node
+func (x *xmlWriter) source(source *shared.Source) {
+	x.open("Source")
+	x.text("Name", source.Name)
+	x.optional("Homepage", source.Homepage)
+	x.open("Packager")
+	x.text("Name", source.Packager.Name)
+	x.text("Email", source.Packager.Email)
+	x.close("Packager")
+	x.close("Source")
+}
+
+// dependency writes a single <Dependency>, whose name is kept as raw XML
+func (x *xmlWriter) dependency(dep *shared.Dependency) {
+	var attrs []xmlAttr
+	if dep.ReleaseFrom != 0 {
+		attrs = append(attrs, xmlAttr{"releaseFrom", strconv.Itoa(dep.ReleaseFrom)})
+	}
+	if dep.ReleaseTo != 0 {
+		attrs = append(attrs, xmlAttr{"releaseTo", strconv.Itoa(dep.ReleaseTo)})
+	}
+	if dep.Release != 0 {
+		attrs = append(attrs, xmlAttr{"release", strconv.Itoa(dep.Release)})
+	}
+	x.raw("Dependency", dep.Name, attrs...)
+}
+
+// packages writes a list of package names, such as <Conflicts>
+func (x *xmlWriter) packages(name string, list *[]string) {
+	if list == nil || len(*list) == 0 {
+		return
+	}
+	x.open(name)
+	for _, pkg := range *list {
+		x.text("Package", pkg)
+	}
+	x.close(name)
+}
+
+// provides writes the <Provides> node, if there is anything provided
+func (x *xmlWriter) provides(provides *shared.Provides) {
+	if len(provides.COMAR)+len(provides.PkgConfig)+len(provides.PkgConfig32) == 0 {
+		return
+	}
+	x.open("Provides")
+	for _, comar := range provides.COMAR {
+		if comar.Script == "" {
+			x.text("COMAR", comar.Value)
+		} else {
+			x.text("COMAR", comar.Value, xmlAttr{"script", comar.Script})
+		}
+	}
+	for _, pc := range provides.PkgConfig {
+		x.text("PkgConfig", pc)
+	}
+	for _, pc := range provides.PkgConfig32 {
+		x.text("PkgConfig32", pc)
+	}
+	x.close("Provides")
+}
+
+// update writes a single <Update> from the history
+func (x *xmlWriter) update(update *shared.Update) {
+	attrs := []xmlAttr{{"release", strconv.Itoa(update.Release)}}
+	if update.Type != "" {
+		attrs = append(attrs, xmlAttr{"type", update.Type})
+	}
+	x.open("Update", attrs...)
+	x.text("Date", update.Date)
+	x.text("Version", update.Version)
+	x.optional("Comment", update.Comment.Value)
+	x.text("Name", update.Name.Value)
+	x.text("Email", update.Email)
+	x.close("Update")
+}
+
+// pkg writes the <Package> node
+func (x *xmlWriter) pkg(p *Package) {
+	x.open("Package")
+	x.text("Name", p.Name)
+	x.localised("Summary", p.Summary)
+	x.localised("Description", p.Description)
+	x.optional("IsA", p.IsA)
+	x.optional("PartOf", p.PartOf)
+	for _, license := range p.License {
+		x.text("License", license)
+	}
+	if p.RuntimeDependencies != nil && len(*p.RuntimeDependencies) > 0 {
+		x.open("RuntimeDependencies")
+		for i := range *p.RuntimeDependencies {
+			x.dependency(&(*p.RuntimeDependencies)[i])
+		}
+		x.close("RuntimeDependencies")
+	}
+	x.packages("Conflicts", p.Conflicts)
+	x.packages("Replaces", p.Replaces)
+	x.provides(&p.Provides)
+	if len(p.History) > 0 {
+		x.open("History")
+		for i := range p.History {
+			x.update(&p.History[i])
+		}
+		x.close("History")
+	}
+	x.optional("BuildHost", p.BuildHost)
+	x.text("Distribution", p.Distribution)
+	x.int("DistributionRelease", int64(p.DistributionRelease))
+	x.text("Architecture", p.Architecture)
+	x.int("InstalledSize", p.InstalledSize)
+	if p.PackageSize != 0 {
+		x.int("PackageSize", p.PackageSize)
+	}
+	x.optional("PackageHash", p.PackageHash)
+	x.optional("PackageURI", p.PackageURI)
+	x.optional("PackageFormat", p.PackageFormat)
+	if p.Source.Name != "" {
+		x.source(&p.Source)
+	}
+	x.close("Package")
+}
+
+// Encode writes the metadata as metadata.xml, byte for byte as eopkg would.
+// Values are written as-is, so the metadata should already be Clean.
+func (m *Metadata) Encode(w io.Writer) error {
+	x := newXMLWriter(w)
+	x.open("PISI")
+	x.source(&m.Source)
+	if m.Package != nil {
+		x.pkg(m.Package)
+	}
+	x.close("PISI")
+	return x.flush()
+}
+
+// Encode writes the list as files.xml, byte for byte as eopkg would
+func (fs *Files) Encode(w io.Writer) error {
+	x := newXMLWriter(w)
+	x.open("Files")
+	for _, f := range fs.File {
+		x.open("File")
+		x.text("Path", f.Path)
+		x.text("Type", string(f.Type))
+		// Directories have neither a size nor a hash
+		if f.Size != 0 || f.Hash != "" {
+			x.int("Size", f.Size)
+		}
+		x.int("Uid", int64(f.UID))
+		x.int("Gid", int64(f.GID))
+		x.raw("Mode", f.Mode.octal())
+		x.optional("Hash", f.Hash)
+		x.optional("Permanent", f.Permanent)
+		x.close("File")
+	}
+	x.close("Files")
+	return x.flush()
+}
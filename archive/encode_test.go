@@ -0,0 +1,142 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"bytes"
+	"encoding/xml"
+	"github.com/getsolus/libeopkg/shared"
+	"io"
+	"strings"
+	"testing"
+)
+
+// goldenPackages are the packages whose XML was written by eopkg itself
+var goldenPackages = []string{
+	"../testdata/delta/nano-4.6-117-1-x86_64.eopkg",
+	"../testdata/delta/nano-4.7-118-1-x86_64.eopkg",
+	"../testdata/delta/nano-117-118-1-x86_64.delta.eopkg",
+}
+
+// readMember reads a member of a package exactly as stored
+func readMember(t *testing.T, pkg *Archive, name string) []byte {
+	member := pkg.FindFile(name)
+	if member == nil {
+		t.Fatalf("Package is missing %s", name)
+	}
+	in, err := member.Open()
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", name, err)
+	}
+	defer in.Close()
+	data, err := io.ReadAll(in)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", name, err)
+	}
+	return data
+}
+
+// checkGolden decodes the golden XML into v, then checks that encoding it
+// again gives back the exact same bytes
+func checkGolden(t *testing.T, golden []byte, v interface{ Encode(io.Writer) error }) {
+	// Decoded without Clean, as the whitespace is part of the golden file
+	if err := xml.NewDecoder(bytes.NewReader(golden)).Decode(v); err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := v.Encode(&buf); err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	if out := buf.Bytes(); !bytes.Equal(out, golden) {
+		lines, want := strings.Split(string(out), "\n"), strings.Split(string(golden), "\n")
+		for i := range want {
+			if i >= len(lines) || lines[i] != want[i] {
+				t.Fatalf("Output differs at line %d:\n got: %q\nwant: %q", i+1, lines[min(i, len(lines)-1)], want[i])
+			}
+		}
+		t.Fatalf("Output has %d extra lines", len(lines)-len(want))
+	}
+}
+
+func TestEncodeGolden(t *testing.T) {
+	for _, path := range goldenPackages {
+		pkg, err := Open(path)
+		if err != nil {
+			t.Fatalf("Error opening valid .eopkg file: %v", err)
+		}
+		defer pkg.Close()
+		checkGolden(t, readMember(t, pkg, "metadata.xml"), &Metadata{})
+		checkGolden(t, readMember(t, pkg, "files.xml"), &Files{})
+	}
+}
+
+func TestEncodeFiles(t *testing.T) {
+	pkg, err := Open(eopkgTestFile)
+	if err != nil {
+		t.Fatalf("Error opening valid .eopkg file: %v", err)
+	}
+	defer pkg.Close()
+	if err = pkg.ReadFiles(); err != nil {
+		t.Fatalf("Failed to read files: %v", err)
+	}
+	// Uid and Gid must survive the round trip, not just happen to be zero
+	pkg.Files.File[0].UID, pkg.Files.File[0].GID = 1000, 100
+	pkg.Files.File[0].Mode = 04755
+	var buf bytes.Buffer
+	if err = pkg.Files.Encode(&buf); err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	if !strings.Contains(buf.String(), "<Uid>1000</Uid>\n        <Gid>100</Gid>\n        <Mode>04755</Mode>") {
+		t.Fatalf("Ownership not written as eopkg would:\n%s", buf.String()[:400])
+	}
+	files := &Files{}
+	if err = xml.NewDecoder(&buf).Decode(files); err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if first := files.File[0]; first.UID != 1000 || first.GID != 100 || first.Mode != 04755 {
+		t.Fatalf("Wrong ownership read back: %d:%d %s", first.UID, first.GID, modeString(first.Mode))
+	}
+}
+
+func TestEncodeOptional(t *testing.T) {
+	conflicts := []string{"vim & co"}
+	meta := &Metadata{Package: &Package{Name: "test", Conflicts: &conflicts, DistributionRelease: 1}}
+	meta.Package.Summary = shared.LocalisedFields{{Value: `"quoted"`, Lang: "en"}}
+	var buf bytes.Buffer
+	if err := meta.Encode(&buf); err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		`<Summary xml:lang="en">&quot;quoted&quot;</Summary>`,
+		"<Conflicts>\n            <Package>vim &amp; co</Package>\n        </Conflicts>",
+		"<DistributionRelease>1</DistributionRelease>",
+		"<InstalledSize>0</InstalledSize>",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("Missing %q from:\n%s", want, out)
+		}
+	}
+	for _, absent := range []string{"PackageSize", "PackageHash", "PackageURI", "Homepage", "IsA", "Provides", "Replaces"} {
+		if strings.Contains(out, absent) {
+			t.Fatalf("Empty %s should be omitted:\n%s", absent, out)
+		}
+	}
+	if strings.HasSuffix(out, "\n") {
+		t.Fatal("eopkg does not end the document with a newline")
+	}
+}
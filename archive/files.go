@@ -17,16 +17,10 @@
 package archive
 
 import (
-	"bytes"
-	"crypto/sha1"
 	"encoding/xml"
-	"fmt"
 	"github.com/getsolus/libeopkg/shared"
-	"io"
 	"os"
-	"path/filepath"
 	"strconv"
-	"syscall"
 )
 
 // File is the idoimatic representation of the XML <File> node
@@ -46,8 +40,8 @@ type File struct {
 	Path      string
 	Type      shared.FileType
 	Size      int64    `xml:",omitempty"`
-	UID       int      `xml:"UID,omitempty"`
-	GID       int      `xml:"GID,omitempty"`
+	UID       int      `xml:"Uid,omitempty"`
+	GID       int      `xml:"Gid,omitempty"`
 	Mode      FileMode `xml:",omitempty"`
 	Hash      string   `xml:",omitempty"`
 	Permanent string   `xml:",omitempty"`
@@ -56,7 +50,7 @@ type File struct {
 // Equal checks if one file is identical to another
 func (f *File) Equal(other *File) bool {
 	return f.Path == other.Path && f.Type == other.Type && f.Size == other.Size &&
-		f.UID == other.UID && other.GID == other.GID && f.Mode == other.Mode &&
+		f.UID == other.UID && f.GID == other.GID && f.Mode == other.Mode &&
 		f.Hash == other.Hash && f.Permanent == other.Permanent
 }
 
@@ -67,51 +61,12 @@ func (f *File) FileMode() os.FileMode {
 
 // Verify reads the copy of this file from disk, hashes it, and compares for the correct hash
 func (f *File) Verify(path string) error {
-	dstPath := filepath.Join(path, f.Path)
-	info, err := os.Lstat(dstPath)
-	if err != nil {
-		return err
-	}
-	if sz := info.Size(); sz != f.Size {
-		return fmt.Errorf("'%s' size mismatch: %d != %d", f.Path, sz, f.Size)
-	}
-	if m := info.Mode().Perm(); m != f.FileMode() {
-		return fmt.Errorf("'%s' permission mismatch: %d != %d", f.Path, m, f.Mode)
-	}
-	stat := info.Sys().(*syscall.Stat_t)
-	if stat.Uid != uint32(f.UID) {
-		return fmt.Errorf("'%s' UID mismatch: %d != %d", f.Path, stat.Uid, uint32(f.UID))
-	}
-	if stat.Gid != uint32(f.GID) {
-		return fmt.Errorf("'%s' GID mismatch: %d != %d", f.Path, stat.Gid, uint32(f.GID))
-	}
-	var in io.Reader
-	if mode := info.Mode(); !mode.IsRegular() {
-		if (mode & os.ModeSymlink) != os.ModeSymlink {
-			return nil
-		}
-		name, err := os.Readlink(dstPath)
-		if err != nil {
-			return err
-		}
-		in = bytes.NewBuffer([]byte(name))
-	} else {
-		dst, err := os.Open(dstPath)
-		if err != nil {
-			return err
-		}
-		defer dst.Close()
-		in = dst
-	}
-	h := sha1.New()
-	if _, err := io.Copy(h, in); err != nil {
-		return err
-	}
-	sum := fmt.Sprintf("%x", h.Sum(nil))
-	if sum != f.Hash {
-		return fmt.Errorf("'%s' hash mismatch: %s != %s", f.Path, sum, f.Hash)
-	}
-	return nil
+	return f.Check(path).err()
+}
+
+// VerifyOwnership is Verify for a rootless or remapped Unpack
+func (f *File) VerifyOwnership(path string, entry *OwnershipEntry) error {
+	return f.CheckOwnership(path, entry).err()
 }
 
 // ReadFiles will read the `files.xml` file within the archive and
@@ -139,66 +94,159 @@ func (p *Archive) ReadFiles() error {
 
 // Files is the idiomatic representation of the XML <Files> node with one or
 // more <File> children
+//
+// Lookups go through an index by path, which is built when files.xml is
+// decoded and by Reindex, and is never changed by a lookup, so any number of
+// goroutines may look up files at once. Files appended since, or replaced in
+// place with the same Path, are still found. Call Reindex after removing a
+// File or changing its Path, and after building a Files by hand, which
+// otherwise has no index at all.
 type Files struct {
 	File []*File
+
+	index   map[string]int
+	indexed int
 }
 
-// HasFile checks if the specified path is listed
-func (fs Files) HasFile(path string) bool {
-	for _, f := range fs.File {
-		if f.Path == path {
-			return true
-		}
+// UnmarshalXML decodes the <File> children, and indexes them by path
+func (fs *Files) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var raw struct {
+		File []*File
+	}
+	if err := d.DecodeElement(&raw, &start); err != nil {
+		return err
 	}
-	return false
+	fs.File = raw.File
+	fs.Reindex()
+	return nil
 }
 
-// Diff creates a new Files from all of the modifications between "other" and this Files
-func (fs *Files) Diff(other *Files) (modified, removed *Files) {
-	modified, removed = &Files{}, &Files{}
-	// Check for modified or removed files
-	for _, curr := range fs.File {
-		found := false
-		for _, next := range other.File {
-			if curr.Path != next.Path {
-				continue
-			}
-			if !curr.Equal(next) {
-				modified.File = append(modified.File, next)
-				found = true
-				break
-			}
+// Reindex rebuilds the index by path
+func (fs *Files) Reindex() {
+	fs.index = make(map[string]int, len(fs.File))
+	// The first entry wins if a path is listed twice
+	for i := len(fs.File) - 1; i >= 0; i-- {
+		fs.index[fs.File[i].Path] = i
+	}
+	fs.indexed = len(fs.File)
+}
+
+// Find looks up the file listed with the specified path, or returns nil.
+// Files which are not indexed are scanned one by one, so a Files built by
+// hand must have Reindex called before looking up more than a few files.
+func (fs Files) Find(path string) *File {
+	from := min(fs.indexed, len(fs.File))
+	if i, ok := fs.index[path]; ok {
+		if i < len(fs.File) && fs.File[i].Path == path {
+			return fs.File[i]
 		}
-		if !found {
-			removed.File = append(removed.File, curr)
+		// The index is out of date, so nothing in it can be trusted
+		from = 0
+	}
+	// Anything listed since the index was built
+	for _, f := range fs.File[from:] {
+		if f.Path == path {
+			return f
 		}
 	}
-	// Check for new files
+	return nil
+}
+
+// HasFile checks if the specified path is listed
+func (fs Files) HasFile(path string) bool {
+	return fs.Find(path) != nil
+}
+
+// FileChange is a file listed in both Files, but with different attributes
+type FileChange struct {
+	Old *File
+	New *File
+}
+
+// FilesDiff is the three way difference between two Files
+type FilesDiff struct {
+	// Added lists the files only in the new Files
+	Added []*File
+	// Changed lists the files in both, but which differ
+	Changed []FileChange
+	// Removed lists the files only in the old Files
+	Removed []*File
+
+	modified []*File
+}
+
+// Empty checks if the two Files were identical
+func (d *FilesDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Changed) == 0 && len(d.Removed) == 0
+}
+
+// Modified lists every file in the new Files that is added or changed, in
+// the order of the new Files
+func (d *FilesDiff) Modified() *Files {
+	modified := &Files{File: d.modified}
+	modified.Reindex()
+	return modified
+}
+
+// Changes finds every file added, changed or removed in "other" compared to
+// this Files. Added and Changed are in the order of "other", and Removed is
+// in the order of this Files.
+func (fs *Files) Changes(other *Files) *FilesDiff {
+	fs, other = fs.withIndex(), other.withIndex()
+	diff := &FilesDiff{}
 	for _, next := range other.File {
-		found := false
-		for _, curr := range fs.File {
-			if next.Equal(curr) {
-				found = true
-				break
-			}
+		curr := fs.Find(next.Path)
+		switch {
+		case curr == nil:
+			diff.Added = append(diff.Added, next)
+		case !curr.Equal(next):
+			diff.Changed = append(diff.Changed, FileChange{Old: curr, New: next})
+		default:
+			continue
 		}
-		if !found {
-			modified.File = append(modified.File, next)
+		diff.modified = append(diff.modified, next)
+	}
+	for _, curr := range fs.File {
+		if !other.HasFile(curr.Path) {
+			diff.Removed = append(diff.Removed, curr)
 		}
 	}
-	return
+	return diff
+}
+
+// withIndex returns fs when its index is current, and otherwise an indexed
+// copy, so that comparing Files built by hand is still linear
+func (fs *Files) withIndex() *Files {
+	if fs.index != nil && fs.indexed == len(fs.File) {
+		return fs
+	}
+	indexed := &Files{File: fs.File}
+	indexed.Reindex()
+	return indexed
+}
+
+// Diff creates a new Files from all of the modifications between "other" and this Files
+func (fs *Files) Diff(other *Files) (modified, removed *Files) {
+	diff := fs.Changes(other)
+	removed = &Files{File: diff.Removed}
+	removed.Reindex()
+	return diff.Modified(), removed
 }
 
 // FileMode is a hexdecimal excoded FileMode
 type FileMode os.FileMode
 
+// octal formats the mode as eopkg does, with a leading zero
+func (fm FileMode) octal() string {
+	if fm == 0 {
+		return "0"
+	}
+	return "0" + strconv.FormatUint(uint64(fm), 8)
+}
+
 // MarshalXML allows writing a FileMode as Hex
 func (fm FileMode) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
-	raw := strconv.FormatUint(uint64(fm), 8)
-	if len(raw) == 3 || len(raw) == 4 {
-		raw = "0" + raw
-	}
-	return e.EncodeElement(raw, start)
+	return e.EncodeElement(fm.octal(), start)
 }
 
 // UnmarshalXML allows reading a FileMode as Hex
@@ -0,0 +1,132 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// manyFiles lists n files, each with a hash derived from its index
+func manyFiles(n int, hash string) *Files {
+	files := &Files{}
+	for i := 0; i < n; i++ {
+		files.File = append(files.File, &File{Path: fmt.Sprintf("usr/share/icons/%d.png", i), Hash: hash})
+	}
+	return files
+}
+
+func TestFilesChanges(t *testing.T) {
+	old, err := OpenAll(deltaOldPkg)
+	if err != nil {
+		t.Fatalf("Error opening valid .eopkg file: %v", err)
+	}
+	defer old.Close()
+	next, err := OpenAll(deltaNewPkg)
+	if err != nil {
+		t.Fatalf("Error opening valid .eopkg file: %v", err)
+	}
+	defer next.Close()
+	// The new release drops one file and gains another
+	gone := next.Files.File[len(next.Files.File)-1]
+	next.Files.File = append(next.Files.File[:len(next.Files.File)-1], &File{Path: "usr/share/nano/new.nanorc"})
+	diff := old.Files.Changes(next.Files)
+	if len(diff.Added) != 1 || diff.Added[0].Path != "usr/share/nano/new.nanorc" {
+		t.Fatalf("Wrong files added: %v", diff.Added)
+	}
+	if len(diff.Removed) != 1 || diff.Removed[0].Path != gone.Path {
+		t.Fatalf("Wrong files removed: %v", diff.Removed)
+	}
+	// Same files as in the delta made by eopkg
+	if len(diff.Changed) != 9 {
+		t.Fatalf("Expected 9 changed files, got %d", len(diff.Changed))
+	}
+	for _, change := range diff.Changed {
+		if change.Old.Path != change.New.Path || change.Old.Hash == change.New.Hash {
+			t.Fatalf("Not a real change: %+v %+v", change.Old, change.New)
+		}
+		if change.Old != old.Files.Find(change.Old.Path) || change.New != next.Files.Find(change.New.Path) {
+			t.Fatal("Change should refer to the listed files")
+		}
+	}
+	if modified := diff.Modified(); len(modified.File) != 10 || !modified.HasFile("usr/share/nano/new.nanorc") {
+		t.Fatalf("Wrong files modified: %d", len(modified.File))
+	}
+	if !old.Files.Changes(old.Files).Empty() {
+		t.Fatal("Identical files should have no changes")
+	}
+}
+
+func TestFilesIndex(t *testing.T) {
+	files := manyFiles(2, "a")
+	if files.Find("usr/share/icons/1.png") == nil || files.HasFile("usr/share/icons/2.png") {
+		t.Fatal("Wrong files found")
+	}
+	files.Reindex()
+	// Appending is noticed without a Reindex
+	files.File = append(files.File, &File{Path: "usr/share/icons/2.png"})
+	if !files.HasFile("usr/share/icons/2.png") {
+		t.Fatal("Appended file was not found")
+	}
+	// So is replacing a file in place
+	replaced := &File{Path: "usr/share/icons/1.png", Hash: "b"}
+	files.File[1] = replaced
+	if files.Find("usr/share/icons/1.png") != replaced {
+		t.Fatal("Replaced file was not found")
+	}
+	files.File[0].Path = "usr/share/icons/renamed.png"
+	if files.HasFile("usr/share/icons/0.png") {
+		t.Fatal("Renamed file should not be found by its old path")
+	}
+	files.Reindex()
+	if !files.HasFile("usr/share/icons/renamed.png") || files.HasFile("usr/share/icons/0.png") {
+		t.Fatal("Reindex did not pick up the rename")
+	}
+}
+
+func TestFilesIndexDecoded(t *testing.T) {
+	var files Files
+	data := "<Files><File><Path>usr/bin/nano</Path></File><File><Path>usr/bin/rnano</Path></File></Files>"
+	if err := xml.Unmarshal([]byte(data), &files); err != nil {
+		t.Fatalf("Failed to decode files.xml: %v", err)
+	}
+	if files.index == nil || files.indexed != 2 {
+		t.Fatal("Decoding should index the files")
+	}
+	// Lookups must not touch the index, so may run at once
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !files.HasFile("usr/bin/rnano") || files.HasFile("usr/bin/vim") {
+				t.Error("Wrong files found")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestFilesChangesLarge(t *testing.T) {
+	// Far too slow to finish if comparing every file with every other
+	old, next := manyFiles(200000, "a"), manyFiles(200000, "b")
+	if diff := old.Changes(next); len(diff.Changed) != 200000 {
+		t.Fatalf("Expected every file to change, got %d", len(diff.Changed))
+	}
+}
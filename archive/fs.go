@@ -0,0 +1,414 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSymlinkHops limits how many symlinks are followed when resolving a path
+const maxSymlinkHops = 40
+
+// ErrSymlinkLoop is returned when resolving a path inside the payload never
+// reaches a real file
+var ErrSymlinkLoop = errors.New("Too many levels of symbolic links")
+
+// PayloadFS is a read-only view of the install tarball of an Archive, which
+// implements fs.FS, fs.ReadDirFS, fs.ReadFileFS and fs.StatFS.
+//
+// The tarball is scanned once, on first access, to build an in-memory index
+// of its entries. Reading a file then decompresses the payload again only up
+// to the end of that entry, so nothing is ever written to disk.
+//
+// Names are relative to the root of the filesystem, as with any fs.FS, i.e.
+// "/usr/bin/nano" is found as "usr/bin/nano". Symlinks are followed within
+// the payload, with absolute targets resolved against the payload root.
+type PayloadFS struct {
+	a       *Archive
+	once    sync.Once
+	err     error
+	entries map[string]*payloadEntry
+}
+
+// payloadEntry is a single entry in the index of a PayloadFS
+type payloadEntry struct {
+	header   *tar.Header
+	index    int      // position of this entry within the tarball
+	children []string // sorted base names, for directories
+}
+
+// FS returns the read-only filesystem view of this archive's payload
+func (a *Archive) FS() *PayloadFS {
+	if a.payload == nil {
+		a.payload = &PayloadFS{a: a}
+	}
+	return a.payload
+}
+
+// load builds the index of tarball entries on first use
+func (p *PayloadFS) load() error {
+	p.once.Do(func() {
+		p.err = p.buildIndex()
+	})
+	return p.err
+}
+
+// buildIndex walks the whole tarball, recording every header
+func (p *PayloadFS) buildIndex() error {
+	rc, err := p.a.openPayload()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	p.entries = map[string]*payloadEntry{
+		".": {header: syntheticDir("."), index: -1},
+	}
+	src := tar.NewReader(rc)
+	for i := 0; ; i++ {
+		header, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := cleanTarName(header.Name)
+		if name == "" {
+			continue
+		}
+		if old, ok := p.entries[name]; ok {
+			if old.header.Typeflag == tar.TypeDir && header.Typeflag == tar.TypeDir {
+				// Keep the children of a directory seen before its own entry
+				old.header, old.index = header, i
+				continue
+			}
+		} else {
+			p.addParents(name)
+		}
+		p.entries[name] = &payloadEntry{header: header, index: i}
+	}
+	for _, entry := range p.entries {
+		sort.Strings(entry.children)
+	}
+	return nil
+}
+
+// addParents registers a new name as a child of its parent, creating any
+// missing parent directories along the way
+func (p *PayloadFS) addParents(name string) {
+	for name != "." {
+		dir := path.Dir(name)
+		parent, exists := p.entries[dir]
+		if !exists {
+			parent = &payloadEntry{header: syntheticDir(dir), index: -1}
+			p.entries[dir] = parent
+		}
+		parent.children = append(parent.children, path.Base(name))
+		if exists {
+			return
+		}
+		name = dir
+	}
+}
+
+// cleanTarName converts a tar entry name to an fs.FS style name
+func cleanTarName(name string) string {
+	name = path.Clean("/" + name)
+	return strings.TrimPrefix(name, "/")
+}
+
+// syntheticDir makes a header for a directory with no entry of its own
+func syntheticDir(name string) *tar.Header {
+	return &tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeDir,
+		Mode:     0755,
+		ModTime:  time.Unix(0, 0),
+	}
+}
+
+// resolve looks up the entry for name, following symlinks in every component
+// and also in the final one when follow is set
+func (p *PayloadFS) resolve(op, name string, follow bool) (string, *payloadEntry, error) {
+	if !fs.ValidPath(name) {
+		return "", nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if err := p.load(); err != nil {
+		return "", nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	hops := 0
+	resolved := "."
+	parts := strings.Split(name, "/")
+	for i := 0; i < len(parts); i++ {
+		if parts[i] == "." {
+			continue
+		}
+		next := path.Join(resolved, parts[i])
+		entry, ok := p.entries[next]
+		if !ok {
+			return "", nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		last := i == len(parts)-1
+		if entry.header.Typeflag != tar.TypeSymlink || (last && !follow) {
+			resolved = next
+			continue
+		}
+		if hops++; hops > maxSymlinkHops {
+			return "", nil, &fs.PathError{Op: op, Path: name, Err: ErrSymlinkLoop}
+		}
+		target := entry.header.Linkname
+		if !path.IsAbs(target) {
+			target = path.Join(resolved, target)
+		}
+		// Restart the walk with the link target spliced in
+		rest := cleanTarName(path.Join(append([]string{target}, parts[i+1:]...)...))
+		parts = strings.Split(rest, "/")
+		resolved = "."
+		i = -1
+	}
+	entry := p.entries[resolved]
+	if entry.header.Typeflag == tar.TypeLink {
+		target, ok := p.entries[cleanTarName(entry.header.Linkname)]
+		if !ok {
+			return "", nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		return resolved, &payloadEntry{header: linkedHeader(entry.header, target.header), index: target.index}, nil
+	}
+	return resolved, entry, nil
+}
+
+// linkedHeader describes a hardlink with the contents of its target
+func linkedHeader(link, target *tar.Header) *tar.Header {
+	h := *target
+	h.Name = link.Name
+	return &h
+}
+
+// Open opens the named file for reading
+func (p *PayloadFS) Open(name string) (fs.File, error) {
+	resolved, entry, err := p.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	info := entryInfo(resolved, entry.header)
+	if entry.header.Typeflag == tar.TypeDir {
+		return &payloadDir{fsys: p, name: resolved, info: info, entry: entry}, nil
+	}
+	return &payloadFile{fsys: p, info: info, entry: entry}, nil
+}
+
+// Stat returns a FileInfo describing the named file, following symlinks
+func (p *PayloadFS) Stat(name string) (fs.FileInfo, error) {
+	resolved, entry, err := p.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return entryInfo(resolved, entry.header), nil
+}
+
+// Lstat returns a FileInfo describing the named file, without following a
+// symlink in the final component
+func (p *PayloadFS) Lstat(name string) (fs.FileInfo, error) {
+	resolved, entry, err := p.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return entryInfo(resolved, entry.header), nil
+}
+
+// ReadLink returns the destination of the named symbolic link
+func (p *PayloadFS) ReadLink(name string) (string, error) {
+	_, entry, err := p.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if entry.header.Typeflag != tar.TypeSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return entry.header.Linkname, nil
+}
+
+// ReadDir reads the named directory, returning its entries sorted by name
+func (p *PayloadFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	resolved, entry, err := p.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if entry.header.Typeflag != tar.TypeDir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return p.dirEntries(resolved, entry), nil
+}
+
+// dirEntries lists the children of a directory entry
+func (p *PayloadFS) dirEntries(dir string, entry *payloadEntry) []fs.DirEntry {
+	list := make([]fs.DirEntry, 0, len(entry.children))
+	for _, child := range entry.children {
+		name := path.Join(dir, child)
+		list = append(list, fs.FileInfoToDirEntry(entryInfo(name, p.entries[name].header)))
+	}
+	return list
+}
+
+// ReadFile reads the named file and returns its contents
+func (p *PayloadFS) ReadFile(name string) ([]byte, error) {
+	f, err := p.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+	buf := make([]byte, info.Size())
+	if _, err = io.ReadFull(f, buf); err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return buf, nil
+}
+
+// openEntry decompresses the payload up to the start of the given entry
+func (p *PayloadFS) openEntry(index int) (io.Reader, io.Closer, error) {
+	rc, err := p.a.openPayload()
+	if err != nil {
+		return nil, nil, err
+	}
+	src := tar.NewReader(rc)
+	for i := 0; i <= index; i++ {
+		if _, err = src.Next(); err != nil {
+			rc.Close()
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, nil, err
+		}
+	}
+	return src, rc, nil
+}
+
+// entryInfo wraps a header so that it reports the right base name
+func entryInfo(name string, header *tar.Header) fs.FileInfo {
+	return &payloadInfo{FileInfo: header.FileInfo(), name: path.Base(name)}
+}
+
+// payloadInfo is a tar FileInfo with the name taken from the resolved path
+type payloadInfo struct {
+	fs.FileInfo
+	name string
+}
+
+// Name returns the base name of the file
+func (i *payloadInfo) Name() string {
+	return i.name
+}
+
+// payloadFile is an open non-directory entry of a PayloadFS
+type payloadFile struct {
+	fsys   *PayloadFS
+	info   fs.FileInfo
+	entry  *payloadEntry
+	src    io.Reader
+	closer io.Closer
+	err    error
+}
+
+// Stat returns the FileInfo for this file
+func (f *payloadFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// Read reads the contents of the file, decompressing on first use
+func (f *payloadFile) Read(b []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	if f.entry.header.Typeflag != tar.TypeReg && f.entry.header.Typeflag != tar.TypeRegA {
+		return 0, io.EOF
+	}
+	if f.src == nil {
+		if f.src, f.closer, f.err = f.fsys.openEntry(f.entry.index); f.err != nil {
+			return 0, f.err
+		}
+	}
+	return f.src.Read(b)
+}
+
+// Close releases the decompressor, if one was used
+func (f *payloadFile) Close() error {
+	if f.err == fs.ErrClosed {
+		return fs.ErrClosed
+	}
+	f.err = fs.ErrClosed
+	if f.closer != nil {
+		return f.closer.Close()
+	}
+	return nil
+}
+
+// payloadDir is an open directory entry of a PayloadFS
+type payloadDir struct {
+	fsys   *PayloadFS
+	name   string
+	info   fs.FileInfo
+	entry  *payloadEntry
+	list   []fs.DirEntry
+	offset int
+}
+
+// Stat returns the FileInfo for this directory
+func (d *payloadDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+// Read always fails for a directory
+func (d *payloadDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+// Close does nothing for a directory
+func (d *payloadDir) Close() error {
+	return nil
+}
+
+// ReadDir returns the next n entries of the directory, as per fs.ReadDirFile
+func (d *payloadDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.list == nil {
+		d.list = d.fsys.dirEntries(d.name, d.entry)
+	}
+	remaining := len(d.list) - d.offset
+	if n > 0 && remaining == 0 {
+		return nil, io.EOF
+	}
+	if n <= 0 || n > remaining {
+		n = remaining
+	}
+	list := d.list[d.offset : d.offset+n]
+	d.offset += n
+	return list, nil
+}
@@ -0,0 +1,98 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+func TestPayloadFS(t *testing.T) {
+	pkg, err := OpenAll(eopkgTestFile)
+	if err != nil {
+		t.Fatalf("Error opening valid .eopkg file: %v", err)
+	}
+	defer pkg.Close()
+	fsys := pkg.FS()
+	bin, err := fs.Sub(fsys, "usr/bin")
+	if err != nil {
+		t.Fatalf("Failed to get sub-tree: %v", err)
+	}
+	if err = fstest.TestFS(bin, "nano", "rnano"); err != nil {
+		t.Fatalf("Payload is not a valid fs.FS: %v", err)
+	}
+	entries, err := fsys.ReadDir(".")
+	if err != nil {
+		t.Fatalf("Failed to read root directory: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "usr" || !entries[0].IsDir() {
+		t.Fatalf("Root directory should only contain usr: %v", entries)
+	}
+	// Every regular file should match its files.xml hash
+	for _, file := range pkg.Files.File {
+		info, err := fsys.Lstat(file.Path)
+		if err != nil {
+			t.Fatalf("Failed to stat '%s': %v", file.Path, err)
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if file.Path != "usr/bin/nano" && file.Path != "usr/share/defaults/nano/nanorc" {
+			continue
+		}
+		data, err := fs.ReadFile(fsys, file.Path)
+		if err != nil {
+			t.Fatalf("Failed to read '%s': %v", file.Path, err)
+		}
+		if sum := fmt.Sprintf("%x", sha1.Sum(data)); sum != file.Hash {
+			t.Fatalf("'%s' hash mismatch: %s != %s", file.Path, sum, file.Hash)
+		}
+	}
+}
+
+func TestPayloadFSSymlink(t *testing.T) {
+	pkg, err := Open(eopkgTestFile)
+	if err != nil {
+		t.Fatalf("Error opening valid .eopkg file: %v", err)
+	}
+	defer pkg.Close()
+	fsys := pkg.FS()
+	target, err := fsys.ReadLink("usr/bin/rnano")
+	if err != nil {
+		t.Fatalf("Failed to read symlink: %v", err)
+	}
+	if target != "nano" {
+		t.Fatalf("Incorrect symlink target: %s", target)
+	}
+	link, err := fsys.Stat("usr/bin/rnano")
+	if err != nil {
+		t.Fatalf("Failed to stat through symlink: %v", err)
+	}
+	if link.Size() != 315944 {
+		t.Fatalf("Symlink should resolve to nano, got size %d", link.Size())
+	}
+	if _, err = fsys.Stat("usr/bin/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Expected ErrNotExist, got: %v", err)
+	}
+	if _, err = fsys.Open("/usr/bin/nano"); !errors.Is(err, fs.ErrInvalid) {
+		t.Fatalf("Expected ErrInvalid for rooted path, got: %v", err)
+	}
+}
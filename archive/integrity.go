@@ -0,0 +1,193 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"archive/tar"
+	"crypto/sha1"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+)
+
+// tarContent is the size and hash of an entry, as files.xml would list it
+type tarContent struct {
+	size int64
+	hash string
+}
+
+// entryKind describes the type of a tar entry for a problem report
+func entryKind(header *tar.Header) string {
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+		return "file"
+	case tar.TypeLink:
+		return "hardlink"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeDir:
+		return "directory"
+	case tar.TypeChar:
+		return "char device"
+	case tar.TypeBlock:
+		return "block device"
+	case tar.TypeFifo:
+		return "fifo"
+	}
+	return fmt.Sprintf("type %q", header.Typeflag)
+}
+
+// contentless are the kinds of entry listed without a hash
+var contentless = map[string]bool{
+	"directory":    true,
+	"char device":  true,
+	"block device": true,
+	"fifo":         true,
+}
+
+// expectedKind describes the type of entry files.xml implies. The Type of a
+// File is only its purpose, such as "data", so the file type bits of the mode
+// are used when present. Otherwise, a missing hash means a directory or one
+// of the other contentless kinds.
+func expectedKind(file *File) string {
+	switch uint32(file.Mode) & unix.S_IFMT {
+	case unix.S_IFDIR:
+		return "directory"
+	case unix.S_IFCHR:
+		return "char device"
+	case unix.S_IFBLK:
+		return "block device"
+	case unix.S_IFIFO:
+		return "fifo"
+	}
+	if file.Hash == "" {
+		return "directory"
+	}
+	return "file"
+}
+
+// kindMatches checks if an entry of the actual kind can be the File
+func kindMatches(file *File, actual string) bool {
+	expected := expectedKind(file)
+	if actual == expected {
+		return true
+	}
+	// Without the file type bits, contentless entries all look alike
+	return uint32(file.Mode)&unix.S_IFMT == 0 && contentless[expected] && contentless[actual]
+}
+
+// CheckIntegrity confirms that files.xml and the install tarball agree, in a
+// single streaming pass over the tarball with nothing written to disk.
+//
+// Every File must have an entry of the right type, size, mode and hash, and
+// every entry other than a directory must be listed in files.xml. Problems
+// from the tarball are in its order, followed by any File that is missing.
+func (a *Archive) CheckIntegrity() ([]*Problem, error) {
+	if err := a.ReadFiles(); err != nil {
+		return nil, err
+	}
+	listed := make(map[string]*File, len(a.Files.File))
+	for _, file := range a.Files.File {
+		listed[file.Path] = file
+	}
+	f, err := a.openPayload()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var problems []*Problem
+	report := func(name string, kind ProblemKind, expected, actual string) {
+		problems = append(problems, &Problem{Path: name, Kind: kind, Expected: expected, Actual: actual})
+	}
+	// Hardlinks need the contents of the regular file they point to
+	contents := make(map[string]tarContent)
+	seen := make(map[string]bool)
+	src := tar.NewReader(f)
+	for {
+		header, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		name := cleanTarName(header.Name)
+		var content *tarContent
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+			h := sha1.New()
+			size, err := io.Copy(h, src)
+			if err != nil {
+				return nil, err
+			}
+			content = &tarContent{size: size, hash: fmt.Sprintf("%x", h.Sum(nil))}
+			contents[name] = *content
+		case tar.TypeSymlink:
+			content = &tarContent{
+				size: int64(len(header.Linkname)),
+				hash: fmt.Sprintf("%x", sha1.Sum([]byte(header.Linkname))),
+			}
+		case tar.TypeLink:
+			if target, ok := contents[cleanTarName(header.Linkname)]; ok {
+				content = &target
+			}
+		}
+		file, ok := listed[name]
+		if !ok {
+			if header.Typeflag != tar.TypeDir {
+				report(name, ProblemUnlisted, "", entryKind(header))
+			}
+			continue
+		}
+		seen[name] = true
+		actual := entryKind(header)
+		if actual == "hardlink" && content != nil || actual == "symlink" {
+			// Both are listed as though they were regular files
+			actual = "file"
+		}
+		if !kindMatches(file, actual) {
+			report(name, ProblemType, expectedKind(file), actual)
+			continue
+		}
+		if mode := FileMode(header.Mode & 07777); mode != file.Mode&07777 {
+			report(name, ProblemMode, modeString(file.Mode&07777), modeString(mode))
+		}
+		if content == nil {
+			continue
+		}
+		if content.size != file.Size {
+			report(name, ProblemSize, fmt.Sprint(file.Size), fmt.Sprint(content.size))
+		}
+		if content.hash != file.Hash {
+			kind := ProblemHash
+			if header.Typeflag == tar.TypeSymlink {
+				kind = ProblemSymlink
+				content.hash = header.Linkname
+			}
+			report(name, kind, file.Hash, content.hash)
+		}
+	}
+	for _, file := range a.Files.File {
+		if !seen[file.Path] {
+			report(file.Path, ProblemMissing, expectedKind(file), "")
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,156 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"archive/tar"
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"testing"
+)
+
+// listFile creates a File as files.xml would list the given contents
+func listFile(path, body string, mode FileMode) *File {
+	return &File{
+		Path: path,
+		Type: "executable",
+		Size: int64(len(body)),
+		Mode: mode,
+		Hash: fmt.Sprintf("%x", sha1.Sum([]byte(body))),
+	}
+}
+
+func TestCheckIntegrityClean(t *testing.T) {
+	pkg, err := Open(eopkgTestFile)
+	if err != nil {
+		t.Fatalf("Error opening valid .eopkg file: %v", err)
+	}
+	defer pkg.Close()
+	problems, err := pkg.CheckIntegrity()
+	if err != nil {
+		t.Fatalf("Failed to check integrity: %v", err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("Valid package has problems: %v", problems)
+	}
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	dir := listFile("usr/lib/dir", "", 0755)
+	dir.Hash, dir.Type = "", "library"
+	files := &Files{File: []*File{
+		listFile("usr/bin/good", "good", 0644),
+		listFile("usr/bin/size", "size", 0644),
+		listFile("usr/bin/mode", "mode", 0644),
+		listFile("usr/bin/hash", "hash", 0644),
+		listFile("usr/bin/hardlink", "good", 0644),
+		listFile("usr/bin/link", "good", 0777),
+		listFile("usr/bin/missing", "missing", 0644),
+		dir,
+	}}
+	data, err := xml.Marshal(files)
+	if err != nil {
+		t.Fatalf("Failed to write files.xml: %v", err)
+	}
+	mode := regEntry("usr/bin/mode", "mode")
+	mode.header.Mode = 04755
+	hardlink := linkEntry(tar.TypeLink, "usr/bin/hardlink", "usr/bin/good")
+	hardlink.header.Mode = 0644
+	pkg := craftPackageFiles(t, string(data),
+		testEntry{header: tar.Header{Typeflag: tar.TypeDir, Name: "usr/", Mode: 0755}},
+		regEntry("usr/bin/good", "good"),
+		regEntry("usr/bin/size", "larger"),
+		mode,
+		regEntry("usr/bin/hash", "HASH"),
+		hardlink,
+		linkEntry(tar.TypeSymlink, "usr/bin/link", "bad"),
+		regEntry("usr/bin/extra", "extra"),
+		regEntry("usr/lib/dir", ""),
+	)
+	defer pkg.Close()
+	problems, err := pkg.CheckIntegrity()
+	if err != nil {
+		t.Fatalf("Failed to check integrity: %v", err)
+	}
+	expected := []struct {
+		path string
+		kind ProblemKind
+	}{
+		{"usr/bin/size", ProblemSize},
+		{"usr/bin/size", ProblemHash},
+		{"usr/bin/mode", ProblemMode},
+		{"usr/bin/hash", ProblemHash},
+		{"usr/bin/link", ProblemSize},
+		{"usr/bin/link", ProblemSymlink},
+		{"usr/bin/extra", ProblemUnlisted},
+		{"usr/lib/dir", ProblemType},
+		{"usr/bin/missing", ProblemMissing},
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("Expected %d problems, got: %v", len(expected), problems)
+	}
+	for i, problem := range problems {
+		if problem.Path != expected[i].path || problem.Kind != expected[i].kind {
+			t.Fatalf("Expected %s problem for %s, got: %v", expected[i].kind, expected[i].path, problem)
+		}
+	}
+}
+
+func TestCheckIntegritySpecial(t *testing.T) {
+	special := func(path string, mode FileMode) *File {
+		return &File{Path: path, Type: "data", Mode: mode}
+	}
+	files := &Files{File: []*File{
+		special("dev", 0755),
+		special("dev/null", 0666),
+		special("dev/loop0", unix.S_IFBLK|0660),
+		special("run/pipe", unix.S_IFIFO|0620),
+		special("run/tty", unix.S_IFCHR|0620),
+		listFile("usr/bin/device", "device", 0644),
+	}}
+	data, err := xml.Marshal(files)
+	if err != nil {
+		t.Fatalf("Failed to write files.xml: %v", err)
+	}
+	pkg := craftPackageFiles(t, string(data),
+		testEntry{header: tar.Header{Typeflag: tar.TypeDir, Name: "dev/", Mode: 0755}},
+		testEntry{header: tar.Header{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0666, Devmajor: 1, Devminor: 3}},
+		testEntry{header: tar.Header{Typeflag: tar.TypeBlock, Name: "dev/loop0", Mode: 0660, Devmajor: 7}},
+		testEntry{header: tar.Header{Typeflag: tar.TypeFifo, Name: "run/pipe", Mode: 0620}},
+		testEntry{header: tar.Header{Typeflag: tar.TypeFifo, Name: "run/tty", Mode: 0620}},
+		testEntry{header: tar.Header{Typeflag: tar.TypeChar, Name: "usr/bin/device", Mode: 0644, Devmajor: 1, Devminor: 5}},
+	)
+	defer pkg.Close()
+	problems, err := pkg.CheckIntegrity()
+	if err != nil {
+		t.Fatalf("Failed to check integrity: %v", err)
+	}
+	expected := []*Problem{
+		{Path: "run/tty", Kind: ProblemType, Expected: "char device", Actual: "fifo"},
+		{Path: "usr/bin/device", Kind: ProblemType, Expected: "file", Actual: "char device"},
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("Expected %d problems, got: %v", len(expected), problems)
+	}
+	for i, problem := range problems {
+		if *problem != *expected[i] {
+			t.Fatalf("Expected %v, got: %v", expected[i], problem)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// OwnershipFile is the name of the sidecar written next to files.xml by a
+// rootless or remapped Unpack
+const OwnershipFile = "ownership.xml"
+
+// ErrUnmappedID is returned when an IDMap has no mapping for an owner in the package
+var ErrUnmappedID = errors.New("No mapping for ID")
+
+// IDMapping maps a contiguous range of IDs in the package onto the host, in
+// the same way as /etc/subuid
+type IDMapping struct {
+	// ID is the first ID in the package
+	ID int
+	// HostID is the first ID on the host
+	HostID int
+	// Size is the number of IDs in the range
+	Size int
+}
+
+// IDMap remaps the ownership of every file when unpacking
+type IDMap struct {
+	UIDs []IDMapping
+	GIDs []IDMapping
+}
+
+// mapID finds the host ID for an ID in the package
+func mapID(ranges []IDMapping, id int) (int, bool) {
+	for _, r := range ranges {
+		if id >= r.ID && id < r.ID+r.Size {
+			return r.HostID + id - r.ID, true
+		}
+	}
+	return 0, false
+}
+
+// UnpackOptions control how the install tarball is extracted
+type UnpackOptions struct {
+	// Rootless skips chown, xattrs and device nodes, so that an unprivileged
+	// user can unpack. Everything skipped is recorded in the sidecar.
+	Rootless bool
+	// IDMap, when set, chowns every file to its mapped host IDs instead
+	IDMap *IDMap
+}
+
+// sidecar checks if these options need ownership to be recorded
+func (o UnpackOptions) sidecar() bool {
+	return o.Rootless || o.IDMap != nil
+}
+
+// Xattr is a single extended attribute, base64 encoded as it may be binary
+type Xattr struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+
+// Device records a device node that could not be created
+type Device struct {
+	// Type is either "char" or "block"
+	Type  string `xml:"type,attr"`
+	Major int64  `xml:"major,attr"`
+	Minor int64  `xml:"minor,attr"`
+}
+
+// OwnershipEntry records the attributes of one entry as intended by the
+// package, and the ownership it was actually given on disk
+type OwnershipEntry struct {
+	Path    string
+	UID     int
+	GID     int
+	HostUID int
+	HostGID int
+	Mode    FileMode
+	Device  *Device `xml:",omitempty"`
+	Xattr   []Xattr `xml:",omitempty"`
+}
+
+// Xattrs decodes the skipped extended attributes of this entry
+func (e *OwnershipEntry) Xattrs() (map[string][]byte, error) {
+	xattrs := make(map[string][]byte)
+	for _, x := range e.Xattr {
+		value, err := base64.StdEncoding.DecodeString(x.Value)
+		if err != nil {
+			return nil, err
+		}
+		xattrs[x.Name] = value
+	}
+	return xattrs, nil
+}
+
+// Ownership is the sidecar manifest for an unpack that could not apply
+// ownership, xattrs or device nodes as the package intended
+type Ownership struct {
+	XMLName xml.Name `xml:"Ownership"`
+	Entry   []*OwnershipEntry
+}
+
+// Find looks up the entry for a path, as listed in files.xml
+func (o *Ownership) Find(path string) *OwnershipEntry {
+	for _, entry := range o.Entry {
+		if entry.Path == path {
+			return entry
+		}
+	}
+	return nil
+}
+
+// byPath indexes the entries by their path
+func (o *Ownership) byPath() map[string]*OwnershipEntry {
+	entries := make(map[string]*OwnershipEntry, len(o.Entry))
+	for _, entry := range o.Entry {
+		entries[entry.Path] = entry
+	}
+	return entries
+}
+
+// ReadOwnership loads the sidecar from the metadata directory of an Unpack
+func ReadOwnership(metaPath string) (o *Ownership, err error) {
+	o = &Ownership{}
+	xmlFile, err := os.Open(filepath.Join(metaPath, OwnershipFile))
+	if err != nil {
+		return
+	}
+	defer xmlFile.Close()
+	dec := xml.NewDecoder(xmlFile)
+	err = dec.Decode(o)
+	return
+}
+
+// Save writes the sidecar into the metadata directory of an Unpack
+func (o *Ownership) Save(metaPath string) error {
+	xmlFile, err := os.Create(filepath.Join(metaPath, OwnershipFile))
+	if err != nil {
+		return err
+	}
+	defer xmlFile.Close()
+	enc := xml.NewEncoder(xmlFile)
+	enc.Indent("", "    ")
+	if err = enc.Encode(o); err != nil {
+		return err
+	}
+	return xmlFile.Sync()
+}
+
+// skippedXattrs collects the xattrs from the PAX records, in a stable order
+func skippedXattrs(paxattrs map[string]string) (xattrs []Xattr) {
+	for attr, value := range paxattrs {
+		if !strings.HasPrefix(attr, "SCHILY.xattr.") {
+			continue
+		}
+		xattrs = append(xattrs, Xattr{
+			Name:  strings.TrimPrefix(attr, "SCHILY.xattr."),
+			Value: base64.StdEncoding.EncodeToString([]byte(value)),
+		})
+	}
+	sort.Slice(xattrs, func(i, j int) bool { return xattrs[i].Name < xattrs[j].Name })
+	return
+}
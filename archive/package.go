@@ -94,7 +94,7 @@ func (p *Package) DeltaName(newRelease int) string {
 	return fmt.Sprintf("%s-%d-%d-%d-%s",
 		p.Name,
 		p.GetRelease(),
-		p.GetRelease(),
+		newRelease,
 		p.DistributionRelease,
 		p.Architecture)
 }
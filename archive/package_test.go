@@ -81,3 +81,17 @@ func TestMetadataSourceDummy(t *testing.T) {
 		}
 	}
 }
+
+func TestDeltaName(t *testing.T) {
+	pkg, err := Open(deltaOldPkg)
+	if err != nil {
+		t.Fatalf("Error opening valid .eopkg file: %v", err)
+	}
+	defer pkg.Close()
+	if err = pkg.ReadMetadata(); err != nil {
+		t.Fatalf("Failed to read metadata: %v", err)
+	}
+	if name := pkg.Meta.Package.DeltaName(118); name != "nano-117-118-1-x86_64" {
+		t.Fatalf("Expected delta name 'nano-117-118-1-x86_64', got '%s'", name)
+	}
+}
@@ -0,0 +1,192 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// ErrBadPatch is returned when a binary patch is corrupt, or was made against
+// a different file
+var ErrBadPatch = errors.New("Binary patch is corrupt")
+
+const (
+	// patchMagic starts every binary patch
+	patchMagic = "EOPKGBP1"
+	// patchBlock is the shortest run of the old file that will be copied
+	patchBlock = 32
+	// patchPrime is the base of the rolling hash
+	patchPrime = 16777619
+)
+
+// Instructions in a binary patch, in the style of VCDIFF
+const (
+	// patchAdd is followed by a length and that many target bytes
+	patchAdd byte = iota
+	// patchCopy is followed by an offset into the old file, relative to the
+	// end of the previous copy, and a length
+	patchCopy
+)
+
+// blockHash hashes a whole block for the rolling hash
+func blockHash(block []byte) (h uint32) {
+	for _, c := range block {
+		h = h*patchPrime + uint32(c)
+	}
+	return
+}
+
+// patchWriter encodes the instructions of a binary patch
+type patchWriter struct {
+	buf  bytes.Buffer
+	last int
+	tmp  [binary.MaxVarintLen64]byte
+}
+
+// add appends literal bytes from the target file
+func (p *patchWriter) add(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	p.buf.WriteByte(patchAdd)
+	p.buf.Write(p.tmp[:binary.PutUvarint(p.tmp[:], uint64(len(data)))])
+	p.buf.Write(data)
+}
+
+// copy appends a run of bytes from the old file
+func (p *patchWriter) copy(offset, length int) {
+	p.buf.WriteByte(patchCopy)
+	p.buf.Write(p.tmp[:binary.PutVarint(p.tmp[:], int64(offset-p.last))])
+	p.buf.Write(p.tmp[:binary.PutUvarint(p.tmp[:], uint64(length))])
+	p.last = offset + length
+}
+
+// MakePatch creates a binary patch which turns old into target. Runs of old
+// are found by indexing it in blocks, and so must be at least 32 bytes long
+// to be copied. Anything else is added as-is, and left to the compression of
+// the delta.
+func MakePatch(old, target []byte) []byte {
+	index := make(map[uint32]int, len(old)/patchBlock+1)
+	for i := 0; i+patchBlock <= len(old); i += patchBlock {
+		h := blockHash(old[i : i+patchBlock])
+		if _, ok := index[h]; !ok {
+			index[h] = i
+		}
+	}
+	// Used to take a character back out of the rolling hash
+	var shift uint32 = 1
+	for i := 1; i < patchBlock; i++ {
+		shift *= patchPrime
+	}
+	p := &patchWriter{}
+	p.buf.WriteString(patchMagic)
+	p.buf.Write(p.tmp[:binary.PutUvarint(p.tmp[:], uint64(len(target)))])
+	// pending is the start of the bytes not yet in the patch, and offset is
+	// where the last copy was found in old relative to target
+	pending, offset := 0, 0
+	var h uint32
+	fresh := true
+	for j := 0; j+patchBlock <= len(target); {
+		if fresh {
+			h, fresh = blockHash(target[j:j+patchBlock]), false
+		}
+		block := target[j : j+patchBlock]
+		// Prefer carrying on from the last copy, as small edits leave the
+		// rest of the file at the same offset
+		i := j + offset
+		found := i >= 0 && i+patchBlock <= len(old) && bytes.Equal(old[i:i+patchBlock], block)
+		if !found {
+			i, found = index[h]
+			found = found && bytes.Equal(old[i:i+patchBlock], block)
+		}
+		if !found {
+			if j+patchBlock < len(target) {
+				h = (h-uint32(target[j])*shift)*patchPrime + uint32(target[j+patchBlock])
+			}
+			j++
+			continue
+		}
+		// Grow the match in both directions
+		start, from := j, i
+		for start > pending && from > 0 && target[start-1] == old[from-1] {
+			start--
+			from--
+		}
+		end, to := j+patchBlock, i+patchBlock
+		for end < len(target) && to < len(old) && target[end] == old[to] {
+			end++
+			to++
+		}
+		p.add(target[pending:start])
+		p.copy(from, end-start)
+		pending, offset, j, fresh = end, from-start, end, true
+	}
+	p.add(target[pending:])
+	return p.buf.Bytes()
+}
+
+// ApplyPatch applies a patch made by MakePatch to old, returning the target file
+func ApplyPatch(old, patch []byte) ([]byte, error) {
+	if !bytes.HasPrefix(patch, []byte(patchMagic)) {
+		return nil, ErrBadPatch
+	}
+	r := bytes.NewReader(patch[len(patchMagic):])
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, ErrBadPatch
+	}
+	// The size is not trusted until the patch has been read
+	target := make([]byte, 0, min(size, uint64(len(old)+len(patch))))
+	last := int64(0)
+	for uint64(len(target)) < size {
+		op, err := r.ReadByte()
+		if err != nil {
+			return nil, ErrBadPatch
+		}
+		switch op {
+		case patchAdd:
+			length, err := binary.ReadUvarint(r)
+			if err != nil || length > uint64(r.Len()) || uint64(len(target))+length > size {
+				return nil, ErrBadPatch
+			}
+			start := len(patch) - r.Len()
+			target = append(target, patch[start:start+int(length)]...)
+			r.Seek(int64(length), io.SeekCurrent)
+		case patchCopy:
+			rel, err := binary.ReadVarint(r)
+			if err != nil {
+				return nil, ErrBadPatch
+			}
+			length, err := binary.ReadUvarint(r)
+			offset := last + rel
+			if err != nil || offset < 0 || length > uint64(len(old)) || offset > int64(len(old))-int64(length) || uint64(len(target))+length > size {
+				return nil, ErrBadPatch
+			}
+			target = append(target, old[offset:offset+int64(length)]...)
+			last = offset + int64(length)
+		default:
+			return nil, ErrBadPatch
+		}
+	}
+	if r.Len() != 0 {
+		return nil, ErrBadPatch
+	}
+	return target, nil
+}
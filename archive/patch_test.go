@@ -0,0 +1,74 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestPatch(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	old := make([]byte, 1<<20)
+	rng.Read(old)
+	// A changed byte, an insertion, a deletion and a moved block
+	target := append([]byte{}, old[:4096]...)
+	target = append(target, 0xff)
+	target = append(target, old[4097:100000]...)
+	target = append(target, []byte("inserted")...)
+	target = append(target, old[100000:500000]...)
+	target = append(target, old[600000:]...)
+	target = append(target, old[:8192]...)
+	patch := MakePatch(old, target)
+	if len(patch) > 1024 {
+		t.Fatalf("Patch is too large: %d bytes", len(patch))
+	}
+	applied, err := ApplyPatch(old, patch)
+	if err != nil {
+		t.Fatalf("Failed to apply patch: %v", err)
+	}
+	if !bytes.Equal(applied, target) {
+		t.Fatal("Patch produced the wrong file")
+	}
+	for _, pair := range [][2][]byte{{nil, nil}, {nil, []byte("new")}, {old, nil}, {[]byte("short"), []byte("shorter")}} {
+		applied, err = ApplyPatch(pair[0], MakePatch(pair[0], pair[1]))
+		if err != nil || !bytes.Equal(applied, pair[1]) {
+			t.Fatalf("Failed to patch %d bytes to %d: %v", len(pair[0]), len(pair[1]), err)
+		}
+	}
+}
+
+func TestPatchCorrupt(t *testing.T) {
+	old := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+	target := append(append([]byte{}, old[:8000]...), old[9000:]...)
+	patch := MakePatch(old, target)
+	for i, bad := range [][]byte{
+		nil,
+		[]byte("not a patch"),
+		patch[:len(patch)-1],
+		append(append([]byte{}, patch...), 0),
+	} {
+		if _, err := ApplyPatch(old, bad); !errors.Is(err, ErrBadPatch) {
+			t.Fatalf("Corrupt patch %d should have failed: %v", i, err)
+		}
+	}
+	if _, err := ApplyPatch(old[:100], patch); !errors.Is(err, ErrBadPatch) {
+		t.Fatalf("Patch against the wrong file should have failed: %v", err)
+	}
+}
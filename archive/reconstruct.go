@@ -0,0 +1,299 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"crypto/sha1"
+	"fmt"
+	"github.com/getsolus/libeopkg/shared"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Reconstructor rebuilds the full package of a new release from the package
+// of the previous release and a delta between the two, as a way of proving
+// that the delta is correct
+type Reconstructor struct {
+	// Old is the package of the previous release
+	Old *Archive
+	// Delta is the delta package from the previous release to the new one
+	Delta *Archive
+	// Codec used for the rebuilt install tarball
+	Codec shared.Codec
+	// Compression settings for the rebuilt install tarball
+	Compression shared.CompressOptions
+	// Reproducible, when set, makes the package depend only on its inputs
+	Reproducible *Reproducible
+}
+
+// NewReconstructor creates a Reconstructor with default compression
+func NewReconstructor(old, delta *Archive) *Reconstructor {
+	return &Reconstructor{
+		Old:         old,
+		Delta:       delta,
+		Codec:       shared.CodecXz,
+		Compression: shared.DefaultCompressOptions,
+	}
+}
+
+// copyPayload copies every entry of the install tarball of src that keep
+// accepts into dst, without any temporary files
+func copyPayload(dst *tar.Writer, src *Archive, r *Reproducible, keep func(name string, header *tar.Header) bool) error {
+	f, err := src.openPayload()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		// Ensure that we compare things in the same way
+		if !keep(strings.TrimSuffix(header.Name, "/"), header) {
+			continue
+		}
+		r.tarHeader(header)
+		if err = dst.WriteHeader(header); err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+			if _, err = io.Copy(dst, tr); err != nil {
+				return err
+			}
+		}
+	}
+	// flush contents to disk
+	return dst.Flush()
+}
+
+// writeTarball merges the two install tarballs, taking everything in the
+// delta, and everything else listed in its files.xml from the old package.
+// The rebuilt tarball is always closed.
+func (r *Reconstructor) writeTarball(cw io.WriteCloser) error {
+	included, err := deltaPaths(r.Delta)
+	if err != nil {
+		cw.Close()
+		return err
+	}
+	// Directories holding listed files are kept, even if not listed themselves
+	listed := make(map[string]bool)
+	parents := make(map[string]bool)
+	for _, f := range r.Delta.Files.File {
+		listed[f.Path] = true
+		for dir := path.Dir(f.Path); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			parents[dir] = true
+		}
+	}
+	written := make(map[string]bool)
+	tw := tar.NewWriter(cw)
+	// Hardlinks must come after their target, which may be in the other
+	// package, so any that would come first are held back until the end
+	var held []*tar.Header
+	hold := func(name string, header *tar.Header) bool {
+		written[name] = true
+		if header.Typeflag == tar.TypeLink && !written[strings.TrimSuffix(header.Linkname, "/")] {
+			held = append(held, header)
+			return false
+		}
+		return true
+	}
+	// Unchanged files come from the old package, and the rest from the delta
+	err = copyPayload(tw, r.Old, r.Reproducible, func(name string, header *tar.Header) bool {
+		if included[name] || written[name] || (!listed[name] && !parents[name]) {
+			return false
+		}
+		return hold(name, header)
+	})
+	if err == nil {
+		err = copyPayload(tw, r.Delta, r.Reproducible, hold)
+	}
+	for _, header := range held {
+		if err != nil {
+			break
+		}
+		r.Reproducible.tarHeader(header)
+		err = tw.WriteHeader(header)
+	}
+	if err != nil {
+		cw.Close()
+		return err
+	}
+	for _, f := range r.Delta.Files.File {
+		if !written[f.Path] {
+			cw.Close()
+			return fmt.Errorf("%w: '%s' is in neither package", ErrDeltaMismatch, f.Path)
+		}
+	}
+	if err = tw.Close(); err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
+}
+
+// Write rebuilds the full package at path. metadata.xml, files.xml and any
+// COMAR scripts are copied untouched from the delta, which always has the
+// same ones as the new package. A DeltaBinary can only be installed, and so
+// is ErrUnsupportedDelta.
+func (r *Reconstructor) Write(path string) error {
+	if err := r.Old.ReadAll(); err != nil {
+		return err
+	}
+	if err := r.Delta.ReadAll(); err != nil {
+		return err
+	}
+	if format, err := r.Delta.DeltaFormat(); err != nil {
+		return err
+	} else if format != DeltaFull {
+		return ErrUnsupportedDelta
+	}
+	if !r.Old.IsDeltaPossible(r.Delta) {
+		return ErrMismatchedDelta
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	zw := zip.NewWriter(out)
+	if err = copyMembers(zw, r.Delta.zipFile, skipDeltaMember, r.Reproducible); err != nil {
+		return err
+	}
+	cw, err := r.Reproducible.createTarball(zw, r.Codec.TarballName(), r.Codec, r.Compression)
+	if err != nil {
+		return err
+	}
+	if err = r.writeTarball(cw); err != nil {
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// Check rebuilds the full package at path, and compares its payload with
+// that of the real package of the new release. It matches when there are no
+// problems.
+func (r *Reconstructor) Check(path string, target *Archive) ([]*Problem, error) {
+	if err := r.Write(path); err != nil {
+		return nil, err
+	}
+	rebuilt, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rebuilt.Close()
+	return rebuilt.ComparePayload(target)
+}
+
+// payloadEntrySummary is what is compared for each entry of a payload
+type payloadEntrySummary struct {
+	header *tar.Header
+	hash   string
+}
+
+// summarisePayload hashes every entry of the install tarball, keeping them in
+// their original order
+func (a *Archive) summarisePayload() (names []string, entries map[string]*payloadEntrySummary, err error) {
+	f, err := a.openPayload()
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	entries = make(map[string]*payloadEntrySummary)
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return names, entries, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		h := sha1.New()
+		if _, err = io.Copy(h, tr); err != nil {
+			return nil, nil, err
+		}
+		name := strings.TrimSuffix(header.Name, "/")
+		if _, ok := entries[name]; !ok {
+			names = append(names, name)
+		}
+		entries[name] = &payloadEntrySummary{header: header, hash: fmt.Sprintf("%x", h.Sum(nil))}
+	}
+}
+
+// ComparePayload compares every entry in the install tarball with that of
+// target, ignoring their order, timestamps and compression. Entries of target
+// that are not in this package are ProblemMissing, and any extra entries are
+// ProblemUnlisted. A ProblemSymlink holds the link name from both payloads.
+func (a *Archive) ComparePayload(target *Archive) ([]*Problem, error) {
+	names, entries, err := a.summarisePayload()
+	if err != nil {
+		return nil, err
+	}
+	targetNames, targetEntries, err := target.summarisePayload()
+	if err != nil {
+		return nil, err
+	}
+	var problems []*Problem
+	add := func(name string, kind ProblemKind, expected, actual string) {
+		problems = append(problems, &Problem{Path: name, Kind: kind, Expected: expected, Actual: actual})
+	}
+	for _, name := range targetNames {
+		want := targetEntries[name]
+		got, ok := entries[name]
+		if !ok {
+			add(name, ProblemMissing, "", "")
+			continue
+		}
+		if got.header.Typeflag != want.header.Typeflag {
+			add(name, ProblemType, string(want.header.Typeflag), string(got.header.Typeflag))
+			continue
+		}
+		if got.header.Size != want.header.Size {
+			add(name, ProblemSize, fmt.Sprint(want.header.Size), fmt.Sprint(got.header.Size))
+		}
+		if got.header.Mode&07777 != want.header.Mode&07777 {
+			add(name, ProblemMode, modeString(FileMode(want.header.Mode&07777)), modeString(FileMode(got.header.Mode&07777)))
+		}
+		if got.header.Uid != want.header.Uid || got.header.Gid != want.header.Gid {
+			add(name, ProblemOwner, ownerString(want.header.Uid, want.header.Gid), ownerString(got.header.Uid, got.header.Gid))
+		}
+		if got.header.Linkname != want.header.Linkname {
+			add(name, ProblemSymlink, want.header.Linkname, got.header.Linkname)
+		}
+		if got.hash != want.hash {
+			add(name, ProblemHash, want.hash, got.hash)
+		}
+	}
+	for _, name := range names {
+		if _, ok := targetEntries[name]; !ok {
+			add(name, ProblemUnlisted, "", "")
+		}
+	}
+	return problems, nil
+}
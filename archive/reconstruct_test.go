@@ -0,0 +1,158 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"github.com/getsolus/libeopkg/shared"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+// openDeltaPackages opens the old, delta and new packages from testdata
+func openDeltaPackages(t *testing.T) (old, delta, target *Archive) {
+	var err error
+	for _, open := range []struct {
+		pkg  **Archive
+		path string
+	}{{&old, deltaOldPkg}, {&delta, deltaPkg}, {&target, deltaNewPkg}} {
+		if *open.pkg, err = OpenAll(open.path); err != nil {
+			t.Fatalf("Error opening %s: %v", open.path, err)
+		}
+		pkg := *open.pkg
+		t.Cleanup(func() { pkg.Close() })
+	}
+	return
+}
+
+func TestReconstruct(t *testing.T) {
+	old, delta, target := openDeltaPackages(t)
+	r := NewReconstructor(old, delta)
+	r.Compression = shared.CompressOptions{Level: 0, Threads: 1}
+	path := filepath.Join(t.TempDir(), "nano.eopkg")
+	problems, err := r.Check(path, target)
+	if err != nil {
+		t.Fatalf("Failed to reconstruct: %v", err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("Rebuilt payload differs from the real package: %v", problems)
+	}
+	rebuilt, err := OpenAll(path)
+	if err != nil {
+		t.Fatalf("Failed to open rebuilt package: %v", err)
+	}
+	defer rebuilt.Close()
+	if rebuilt.Meta.Package.GetRelease() != 118 || len(rebuilt.Files.File) != len(target.Files.File) {
+		t.Fatal("Rebuilt package has the wrong metadata")
+	}
+	if problems, err = rebuilt.CheckIntegrity(); err != nil || len(problems) != 0 {
+		t.Fatalf("Rebuilt package is inconsistent: %v %v", problems, err)
+	}
+	// The old release differs only in content
+	if problems, err = rebuilt.ComparePayload(old); err != nil {
+		t.Fatalf("Failed to compare payloads: %v", err)
+	}
+	if len(problems) == 0 {
+		t.Fatal("Rebuilt package should differ from the old release")
+	}
+	for _, problem := range problems {
+		if problem.Kind != ProblemHash && problem.Kind != ProblemSize {
+			t.Fatalf("Unexpected problem: %v", problem)
+		}
+	}
+}
+
+func TestReconstructMismatch(t *testing.T) {
+	_, delta, target := openDeltaPackages(t)
+	r := NewReconstructor(target, delta)
+	if err := r.Write(filepath.Join(t.TempDir(), "nano.eopkg")); !errors.Is(err, ErrMismatchedDelta) {
+		t.Fatalf("Expected ErrMismatchedDelta, got %v", err)
+	}
+}
+
+func TestComparePayloadSymlink(t *testing.T) {
+	pkg := craftPackage(t, linkEntry(tar.TypeSymlink, "usr/bin/link", "nano"))
+	defer pkg.Close()
+	target := craftPackage(t, linkEntry(tar.TypeSymlink, "usr/bin/link", "rnano"))
+	defer target.Close()
+	problems, err := pkg.ComparePayload(target)
+	if err != nil {
+		t.Fatalf("Failed to compare payloads: %v", err)
+	}
+	if len(problems) != 1 || problems[0].Kind != ProblemSymlink {
+		t.Fatalf("Expected a single symlink problem, got: %v", problems)
+	}
+	if problems[0].Expected != "rnano" || problems[0].Actual != "nano" {
+		t.Fatalf("Symlink problem should hold both targets: %v", problems[0])
+	}
+}
+
+func TestReconstructHardlinkOrder(t *testing.T) {
+	files := &Files{File: []*File{
+		listFile("usr/bin/nano", "new", 0755),
+		listFile("usr/bin/rnano", "new", 0755),
+	}}
+	data, err := xml.Marshal(files)
+	if err != nil {
+		t.Fatalf("Failed to write files.xml: %v", err)
+	}
+	// The hardlink is unchanged, but its target is only in the delta
+	old := craftPackageFiles(t, string(data),
+		regEntry("usr/bin/nano", "old"),
+		linkEntry(tar.TypeLink, "usr/bin/rnano", "usr/bin/nano"),
+	)
+	defer old.Close()
+	delta := craftPackageFiles(t, string(data), regEntry("usr/bin/nano", "new"))
+	defer delta.Close()
+	if err = delta.ReadAll(); err != nil {
+		t.Fatalf("Failed to read delta: %v", err)
+	}
+	r := NewReconstructor(old, delta)
+	r.Compression = shared.CompressOptions{Level: 0, Threads: 1}
+	var buf bytes.Buffer
+	cw, err := shared.NewWriter(r.Codec, &buf, r.Compression)
+	if err != nil {
+		t.Fatalf("Failed to create compressor: %v", err)
+	}
+	if err = r.writeTarball(cw); err != nil {
+		t.Fatalf("Failed to write tarball: %v", err)
+	}
+	xr, err := shared.NewXzReader(&buf, r.Compression)
+	if err != nil {
+		t.Fatalf("Failed to decompress tarball: %v", err)
+	}
+	defer xr.Close()
+	var names []string
+	tr := tar.NewReader(xr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read tarball: %v", err)
+		}
+		names = append(names, header.Name)
+	}
+	if len(names) != 2 || names[0] != "usr/bin/nano" || names[1] != "usr/bin/rnano" {
+		t.Fatalf("Hardlink should come after its target: %v", names)
+	}
+}
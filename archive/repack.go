@@ -0,0 +1,91 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"archive/zip"
+	"github.com/getsolus/libeopkg/shared"
+	"os"
+	"path/filepath"
+)
+
+// Repack writes a copy of this package to path with the current Meta, which
+// may have been changed since it was read. files.xml, comar/ and the install
+// tarball are copied untouched, but any embedded signature is dropped as it
+// no longer matches. Meta is updated with the PackageSize and PackageHash of
+// the new package, and left as it was if anything fails.
+//
+// The new package is written alongside path and then renamed into place, so
+// path may be the package itself.
+func (a *Archive) Repack(path string) (err error) {
+	if a.Meta == nil {
+		if err := a.ReadMetadata(); err != nil {
+			return err
+		}
+	}
+	original := a.FindFile("metadata.xml")
+	if original == nil {
+		return shared.ErrEopkgCorrupted
+	}
+	out, err := os.CreateTemp(filepath.Dir(path), ".repack-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	// These describe the package they are in, so can never be correct within it
+	pkg := a.Meta.Package
+	size, hash := pkg.PackageSize, pkg.PackageHash
+	pkg.PackageSize, pkg.PackageHash = 0, ""
+	defer func() {
+		if err != nil {
+			pkg.PackageSize, pkg.PackageHash = size, hash
+		}
+	}()
+	zw := zip.NewWriter(out)
+	// Keep the same name, compression and timestamp as the original
+	header := &zip.FileHeader{Name: original.Name, Method: original.Method, Modified: original.Modified}
+	header.SetMode(original.Mode())
+	w, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	if err = a.Meta.Encode(w); err != nil {
+		return err
+	}
+	err = copyMembers(zw, a.zipFile, func(f *zip.File) bool {
+		return f.Name == original.Name || f.Name == SignatureFile
+	}, nil)
+	if err != nil {
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	// CreateTemp leaves the package readable only by its owner
+	if err = out.Chmod(0644); err != nil {
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		return err
+	}
+	if err = os.Rename(out.Name(), path); err != nil {
+		return err
+	}
+	pkg.PackageSize, pkg.PackageHash, err = hashPackage(path)
+	return err
+}
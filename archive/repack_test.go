@@ -0,0 +1,105 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"github.com/getsolus/libeopkg/shared"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepack(t *testing.T) {
+	path := copyPackage(t)
+	pkg, err := OpenAll(path)
+	if err != nil {
+		t.Fatalf("Error opening valid .eopkg file: %v", err)
+	}
+	defer pkg.Close()
+	before, err := pkg.digests()
+	if err != nil {
+		t.Fatalf("Failed to hash members: %v", err)
+	}
+	meta := pkg.Meta.Package
+	meta.Distribution = "Solus Fixed"
+	meta.PartOf = "editor"
+	deps := append(*meta.RuntimeDependencies, shared.Dependency{Name: "libmagic", ReleaseFrom: 3})
+	meta.RuntimeDependencies = &deps
+	// Repacked in place, over the open package
+	if err = pkg.Repack(path); err != nil {
+		t.Fatalf("Failed to repack: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read package: %v", err)
+	}
+	if meta.PackageSize != int64(len(data)) || meta.PackageHash != fmt.Sprintf("%x", sha1.Sum(data)) {
+		t.Fatal("Incorrect package size or hash")
+	}
+	repacked, err := OpenAll(path)
+	if err != nil {
+		t.Fatalf("Failed to open repacked package: %v", err)
+	}
+	defer repacked.Close()
+	fixed := repacked.Meta.Package
+	if fixed.Distribution != "Solus Fixed" || fixed.PartOf != "editor" || len(*fixed.RuntimeDependencies) != 4 {
+		t.Fatalf("Metadata was not changed: %s %s %v", fixed.Distribution, fixed.PartOf, *fixed.RuntimeDependencies)
+	}
+	if fixed.PackageSize != 0 || fixed.PackageHash != "" {
+		t.Fatal("Package should not record its own size or hash")
+	}
+	after, err := repacked.digests()
+	if err != nil {
+		t.Fatalf("Failed to hash members: %v", err)
+	}
+	if len(after) != len(before) {
+		t.Fatalf("Expected %d members, got %d", len(before), len(after))
+	}
+	for i, d := range after {
+		if d.Name != before[i].Name {
+			t.Fatalf("Expected member %s, got %s", before[i].Name, d.Name)
+		}
+		if d.Name != "metadata.xml" && d != before[i] {
+			t.Fatalf("'%s' should have been copied untouched", d.Name)
+		}
+	}
+}
+
+func TestRepackFailure(t *testing.T) {
+	pkg, err := OpenAll(eopkgTestFile)
+	if err != nil {
+		t.Fatalf("Error opening valid .eopkg file: %v", err)
+	}
+	defer pkg.Close()
+	meta := pkg.Meta.Package
+	// As a repository tool would record them, from the previous repack
+	size, hash := int64(1234), "0123456789abcdef0123456789abcdef01234567"
+	meta.PackageSize, meta.PackageHash = size, hash
+	// A package cannot be renamed over a directory that is in use
+	dir := t.TempDir()
+	if err = os.WriteFile(filepath.Join(dir, "keep"), nil, 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err = pkg.Repack(dir); err == nil {
+		t.Fatal("Repack over a directory should fail")
+	}
+	if meta.PackageSize != size || meta.PackageHash != hash {
+		t.Fatalf("Failed repack changed the metadata: %d %s", meta.PackageSize, meta.PackageHash)
+	}
+}
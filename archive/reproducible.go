@@ -0,0 +1,131 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"github.com/getsolus/libeopkg/shared"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// DefaultEpoch is the timestamp used for reproducible output when
+// SOURCE_DATE_EPOCH is not set. It is the earliest time a zip can record.
+var DefaultEpoch = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// maxEpoch is the latest time a zip can record
+var maxEpoch = time.Date(2107, time.December, 31, 23, 59, 58, 0, time.UTC)
+
+// Reproducible makes the packages and deltas that are written depend only on
+// their inputs, so that writing them twice gives the same bytes
+type Reproducible struct {
+	// Time is given to every member of the zip and every entry of the tarball.
+	// It must be a time a zip can record, from DefaultEpoch to the end of 2107.
+	Time time.Time
+}
+
+// NewReproducible uses SOURCE_DATE_EPOCH for the timestamp if it is set, or
+// else DefaultEpoch. The timestamp is clamped to the times a zip can record.
+func NewReproducible() (*Reproducible, error) {
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		return &Reproducible{Time: DefaultEpoch}, nil
+	}
+	secs, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SOURCE_DATE_EPOCH '%s': %w", epoch, err)
+	}
+	t := time.Unix(secs, 0).UTC()
+	if t.Before(DefaultEpoch) {
+		t = DefaultEpoch
+	} else if t.After(maxEpoch) {
+		t = maxEpoch
+	}
+	return &Reproducible{Time: t}, nil
+}
+
+// newZipHeader creates the header for a new member of a package, stamped
+// with the current time unless output is reproducible
+func (r *Reproducible) newZipHeader(name string, method uint16) *zip.FileHeader {
+	header := &zip.FileHeader{Name: name, Method: method, Modified: time.Now()}
+	header.SetMode(0644)
+	r.zipHeader(header)
+	return header
+}
+
+// createTarball adds the install tarball to a package, returning the writer
+// that compresses into it. The tarball is already compressed, so is stored
+// as-is.
+func (r *Reproducible) createTarball(zw *zip.Writer, name string, codec shared.Codec, opts shared.CompressOptions) (io.WriteCloser, error) {
+	w, err := zw.CreateHeader(r.newZipHeader(name, zip.Store))
+	if err != nil {
+		return nil, err
+	}
+	return shared.NewWriter(codec, w, r.compression(codec, opts))
+}
+
+// zipHeader normalises the timestamp, permissions and extra fields of a zip
+// member, which can otherwise record the owner and times of the host
+func (r *Reproducible) zipHeader(header *zip.FileHeader) {
+	if r == nil {
+		return
+	}
+	header.Modified = r.Time
+	// CreateRaw only writes the MS-DOS fields, so these are set directly
+	t := r.Time.UTC()
+	header.ModifiedDate = uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+	header.ModifiedTime = uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+	header.Extra = nil
+	header.Comment = ""
+	header.SetMode(0644)
+}
+
+// tarHeader normalises the times and owner names of a tarball entry. The
+// numeric owner is kept, as it is part of the package.
+func (r *Reproducible) tarHeader(header *tar.Header) {
+	if r == nil {
+		return
+	}
+	header.ModTime = r.Time
+	header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+	header.Uname, header.Gname = "", ""
+	for _, key := range []string{"mtime", "atime", "ctime", "uname", "gname"} {
+		delete(header.PAXRecords, key)
+	}
+	// Let the writer pick the simplest format that fits
+	header.Format = tar.FormatUnknown
+}
+
+// compression pins the compression settings. The output of the host tools
+// depends on their version, so the native backend is used wherever it can
+// write the codec.
+func (r *Reproducible) compression(codec shared.Codec, opts shared.CompressOptions) shared.CompressOptions {
+	if r == nil {
+		return opts
+	}
+	if codec != shared.CodecBzip2 {
+		opts.Backend = shared.BackendNative
+	}
+	if opts.Threads < 1 {
+		opts.Threads = 1
+	}
+	return opts
+}
@@ -0,0 +1,148 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// checkNormalised makes sure every timestamp and owner name in the package
+// has been normalised
+func checkNormalised(t *testing.T, path string, epoch time.Time) {
+	pkg, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open package: %v", err)
+	}
+	defer pkg.Close()
+	for _, f := range pkg.zipFile.File {
+		if !f.Modified.Equal(epoch) || f.Mode() != 0644 {
+			t.Fatalf("'%s' was not normalised: %v %v", f.Name, f.Modified, f.Mode())
+		}
+	}
+	in, err := pkg.openPayload()
+	if err != nil {
+		t.Fatalf("Failed to open payload: %v", err)
+	}
+	defer in.Close()
+	tr := tar.NewReader(in)
+	for header, err := tr.Next(); err == nil; header, err = tr.Next() {
+		if !header.ModTime.Equal(epoch) || header.Uname != "" || header.Gname != "" {
+			t.Fatalf("'%s' was not normalised: %v %s:%s", header.Name, header.ModTime, header.Uname, header.Gname)
+		}
+	}
+}
+
+func TestReproducibleBuild(t *testing.T) {
+	pkg, root := unpackNano(t)
+	if err := pkg.ReadAll(); err != nil {
+		t.Fatalf("Error reading package: %v", err)
+	}
+	repro := &Reproducible{Time: DefaultEpoch}
+	var outputs [][]byte
+	for i := 0; i < 2; i++ {
+		// Only the timestamps on disk differ between the builds
+		stamp := time.Now().Add(time.Duration(i) * time.Hour)
+		if err := os.Chtimes(filepath.Join(root, "usr/bin/nano"), stamp, stamp); err != nil {
+			t.Fatalf("Failed to touch file: %v", err)
+		}
+		b := fastBuilder(root, pkg.Meta)
+		b.Files = pkg.Files
+		b.Reproducible = repro
+		path := filepath.Join(t.TempDir(), "nano.eopkg")
+		if _, err := b.Build(path); err != nil {
+			t.Fatalf("Failed to build package: %v", err)
+		}
+		checkNormalised(t, path, DefaultEpoch)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read package: %v", err)
+		}
+		outputs = append(outputs, data)
+	}
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Fatal("Building the same files twice gave different packages")
+	}
+}
+
+func TestReproducibleDelta(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1577836800")
+	repro, err := NewReproducible()
+	if err != nil {
+		t.Fatalf("Failed to read SOURCE_DATE_EPOCH: %v", err)
+	}
+	epoch := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	if !repro.Time.Equal(epoch) {
+		t.Fatalf("Wrong epoch: %v", repro.Time)
+	}
+	var outputs [][]byte
+	for i := 0; i < 2; i++ {
+		producer, err := NewDeltaProducer(t.TempDir(), deltaOldPkg, deltaNewPkg)
+		if err != nil {
+			t.Fatalf("Failed to create delta producer for existing pkgs: %v", err)
+		}
+		defer producer.Close()
+		producer.Reproducible = repro
+		path, err := producer.Create()
+		if err != nil {
+			t.Fatalf("Failed to produce delta package: %v", err)
+		}
+		checkNormalised(t, path, epoch)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read delta: %v", err)
+		}
+		outputs = append(outputs, data)
+	}
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Fatal("Producing the same delta twice gave different packages")
+	}
+}
+
+func TestReproducibleInvalidEpoch(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	if _, err := NewReproducible(); err == nil {
+		t.Fatal("Should have rejected an invalid SOURCE_DATE_EPOCH")
+	}
+}
+
+func TestReproducibleEpochRange(t *testing.T) {
+	for epoch, expected := range map[string]time.Time{
+		"0":           DefaultEpoch,
+		"-1":          DefaultEpoch,
+		"99999999999": time.Date(2107, time.December, 31, 23, 59, 58, 0, time.UTC),
+	} {
+		t.Setenv("SOURCE_DATE_EPOCH", epoch)
+		r, err := NewReproducible()
+		if err != nil {
+			t.Fatalf("Failed to use SOURCE_DATE_EPOCH=%s: %v", epoch, err)
+		}
+		if !r.Time.Equal(expected) {
+			t.Fatalf("SOURCE_DATE_EPOCH=%s should be clamped to %v, got %v", epoch, expected, r.Time)
+		}
+		header := r.newZipHeader("metadata.xml", zip.Deflate)
+		year := 1980 + int(header.ModifiedDate>>9)
+		if year != expected.Year() || header.ModifiedDate&0x1f != uint16(expected.Day()) {
+			t.Fatalf("SOURCE_DATE_EPOCH=%s gave the wrong MS-DOS date: %d", epoch, header.ModifiedDate)
+		}
+	}
+}
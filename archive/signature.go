@@ -0,0 +1,336 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SignatureFile is the name of the signature member embedded in a package
+const SignatureFile = "signature.xml"
+
+// DetachedSuffix is appended to the package filename for a detached signature
+const DetachedSuffix = ".sig"
+
+// signatureAlgorithm is the only algorithm supported so far
+const signatureAlgorithm = "ed25519"
+
+// signatureHeader starts the signed message, to keep it from being mistaken
+// for anything else
+const signatureHeader = "eopkg-signature-v1\n"
+
+var (
+	// ErrUnsigned is returned when a package has no signature at all
+	ErrUnsigned = errors.New("Package is not signed")
+
+	// ErrUnknownKey is returned when the signing key is not in the keyring
+	ErrUnknownKey = errors.New("Package is signed by an unknown key")
+
+	// ErrBadSignature is returned when the signature does not match the package
+	ErrBadSignature = errors.New("Package signature is invalid")
+)
+
+// KeyID is a short, stable identifier for a public key
+func KeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return fmt.Sprintf("%x", sum[:8])
+}
+
+// Keyring is the set of keys trusted to sign packages
+type Keyring interface {
+	// PublicKey finds a trusted key by its KeyID, or returns ErrUnknownKey
+	PublicKey(id string) (ed25519.PublicKey, error)
+}
+
+// LocalKeyring is a Keyring held in memory, usually loaded from a directory
+type LocalKeyring struct {
+	keys map[string]ed25519.PublicKey
+}
+
+// NewKeyring creates an empty LocalKeyring
+func NewKeyring() *LocalKeyring {
+	return &LocalKeyring{keys: make(map[string]ed25519.PublicKey)}
+}
+
+// LoadKeyring trusts every "*.pub" file in dir, each holding a base64
+// encoded ed25519 public key
+func LoadKeyring(dir string) (*LocalKeyring, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pub"))
+	if err != nil {
+		return nil, err
+	}
+	k := NewKeyring()
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("'%s' is not an ed25519 public key", path)
+		}
+		k.Add(key)
+	}
+	return k, nil
+}
+
+// Add trusts a public key, returning its KeyID
+func (k *LocalKeyring) Add(key ed25519.PublicKey) string {
+	id := KeyID(key)
+	k.keys[id] = key
+	return id
+}
+
+// PublicKey finds a trusted key by its KeyID
+func (k *LocalKeyring) PublicKey(id string) (ed25519.PublicKey, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// Digest is the SHA-256 hash of a single member of the package, exactly as it
+// is stored in the zip
+type Digest struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+
+// Signature authenticates every member of a package, including metadata.xml,
+// files.xml and the install tarball. It can be embedded in the package as
+// SignatureFile, or kept alongside it as a detached ".sig" file.
+type Signature struct {
+	XMLName   xml.Name `xml:"Signature"`
+	Algorithm string
+	KeyID     string
+	Digest    []Digest
+	Value     string
+}
+
+// digests hashes every member of the package other than the signature
+func (a *Archive) digests() ([]Digest, error) {
+	var digests []Digest
+	for _, f := range a.zipFile.File {
+		if f.Name == SignatureFile {
+			continue
+		}
+		in, err := f.OpenRaw()
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		if _, err = io.Copy(h, in); err != nil {
+			return nil, err
+		}
+		digests = append(digests, Digest{Name: f.Name, Value: fmt.Sprintf("%x", h.Sum(nil))})
+	}
+	sort.Slice(digests, func(i, j int) bool { return digests[i].Name < digests[j].Name })
+	return digests, nil
+}
+
+// message is what is actually signed
+func (s *Signature) message() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(signatureHeader)
+	for _, d := range s.Digest {
+		fmt.Fprintf(&buf, "%s %s\n", d.Value, d.Name)
+	}
+	return buf.Bytes()
+}
+
+// Sign creates a signature for this package with the given key
+func (a *Archive) Sign(key ed25519.PrivateKey) (*Signature, error) {
+	digests, err := a.digests()
+	if err != nil {
+		return nil, err
+	}
+	s := &Signature{
+		Algorithm: signatureAlgorithm,
+		KeyID:     KeyID(key.Public().(ed25519.PublicKey)),
+		Digest:    digests,
+	}
+	s.Value = base64.StdEncoding.EncodeToString(ed25519.Sign(key, s.message()))
+	return s, nil
+}
+
+// Verify checks that the signature was made by a trusted key, and that it
+// covers exactly the members of the package
+func (s *Signature) Verify(a *Archive, keyring Keyring) error {
+	if s.Algorithm != signatureAlgorithm {
+		return fmt.Errorf("%w: unsupported algorithm '%s'", ErrBadSignature, s.Algorithm)
+	}
+	key, err := keyring.PublicKey(s.KeyID)
+	if err != nil {
+		return err
+	}
+	value, err := base64.StdEncoding.DecodeString(s.Value)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+	if !ed25519.Verify(key, s.message(), value) {
+		return ErrBadSignature
+	}
+	// The signature is genuine, so now the package must match it
+	digests, err := a.digests()
+	if err != nil {
+		return err
+	}
+	if len(digests) != len(s.Digest) {
+		return fmt.Errorf("%w: package has %d members, but %d were signed", ErrBadSignature, len(digests), len(s.Digest))
+	}
+	for i, d := range digests {
+		if d != s.Digest[i] {
+			return fmt.Errorf("%w: '%s' has been modified", ErrBadSignature, d.Name)
+		}
+	}
+	return nil
+}
+
+// decodeSignature reads a signature from XML
+func decodeSignature(in io.Reader) (s *Signature, err error) {
+	s = &Signature{}
+	dec := xml.NewDecoder(in)
+	err = dec.Decode(s)
+	return
+}
+
+// ReadSignature loads a detached signature
+func ReadSignature(path string) (*Signature, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return decodeSignature(f)
+}
+
+// Save writes the signature out as a detached signature
+func (s *Signature) Save(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = s.encode(f); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// encode writes the signature as XML
+func (s *Signature) encode(out io.Writer) error {
+	enc := xml.NewEncoder(out)
+	enc.Indent("", "    ")
+	return enc.Encode(s)
+}
+
+// Signature finds the signature for this package, either embedded within it,
+// or detached alongside it
+func (a *Archive) Signature() (*Signature, error) {
+	if member := a.FindFile(SignatureFile); member != nil {
+		in, err := member.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer in.Close()
+		return decodeSignature(in)
+	}
+	if a.Path == "" {
+		return nil, ErrUnsigned
+	}
+	s, err := ReadSignature(a.Path + DetachedSuffix)
+	if os.IsNotExist(err) {
+		return nil, ErrUnsigned
+	}
+	return s, err
+}
+
+// VerifySignature checks that this package was signed by a trusted key
+func (a *Archive) VerifySignature(keyring Keyring) error {
+	s, err := a.Signature()
+	if err != nil {
+		return err
+	}
+	return s.Verify(a, keyring)
+}
+
+// WriteSigned writes a copy of this package to path, with the signature
+// embedded as its last member. Every other member is copied untouched.
+func (a *Archive) WriteSigned(path string, s *Signature) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	zw := zip.NewWriter(out)
+	// Replace any existing signature
+	err = copyMembers(zw, a.zipFile, func(f *zip.File) bool {
+		return f.Name == SignatureFile
+	}, nil)
+	if err != nil {
+		return err
+	}
+	member, err := zw.Create(SignatureFile)
+	if err != nil {
+		return err
+	}
+	if err = s.encode(member); err != nil {
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// RequireSignature is VerifySignature, but the package is closed when it is
+// not validly signed by a trusted key, so it cannot be used by mistake. It is
+// the way to require a signature after OpenReader or OpenBytes, where only an
+// embedded signature can be found.
+func (a *Archive) RequireSignature(keyring Keyring) error {
+	if err := a.VerifySignature(keyring); err != nil {
+		a.Close()
+		return err
+	}
+	return nil
+}
+
+// OpenSigned is Open, but refuses a package without a valid signature from
+// a trusted key
+func OpenSigned(path string, keyring Keyring) (*Archive, error) {
+	a, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = a.RequireSignature(keyring); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
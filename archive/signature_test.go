@@ -0,0 +1,210 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testKey is a fixed signing key, and a keyring that trusts it
+func testKey(t *testing.T) (ed25519.PrivateKey, *LocalKeyring) {
+	key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	dir := t.TempDir()
+	pub := base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	if err := os.WriteFile(filepath.Join(dir, "solus.pub"), []byte(pub+"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write public key: %v", err)
+	}
+	keyring, err := LoadKeyring(dir)
+	if err != nil {
+		t.Fatalf("Failed to load keyring: %v", err)
+	}
+	return key, keyring
+}
+
+// copyPackage copies the test package somewhere it can be signed
+func copyPackage(t *testing.T) string {
+	data, err := os.ReadFile(eopkgTestFile)
+	if err != nil {
+		t.Fatalf("Failed to read package: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), filepath.Base(eopkgTestFile))
+	if err = os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Failed to copy package: %v", err)
+	}
+	return path
+}
+
+// signPackage signs the package at path with key
+func signPackage(t *testing.T, path string, key ed25519.PrivateKey) *Signature {
+	pkg, err := Open(path)
+	if err != nil {
+		t.Fatalf("Error opening valid .eopkg file: %v", err)
+	}
+	defer pkg.Close()
+	sig, err := pkg.Sign(key)
+	if err != nil {
+		t.Fatalf("Failed to sign package: %v", err)
+	}
+	return sig
+}
+
+func TestSignatureDetached(t *testing.T) {
+	key, keyring := testKey(t)
+	path := copyPackage(t)
+	if _, err := OpenSigned(path, keyring); err != ErrUnsigned {
+		t.Fatalf("Expected ErrUnsigned, got: %v", err)
+	}
+	if err := signPackage(t, path, key).Save(path + DetachedSuffix); err != nil {
+		t.Fatalf("Failed to save signature: %v", err)
+	}
+	pkg, err := OpenSigned(path, keyring)
+	if err != nil {
+		t.Fatalf("Failed to open signed package: %v", err)
+	}
+	pkg.Close()
+	if _, err = OpenSigned(path, NewKeyring()); err != ErrUnknownKey {
+		t.Fatalf("Expected ErrUnknownKey, got: %v", err)
+	}
+	// Sign something else, and pass it off as this package
+	other := signPackage(t, "../testdata/delta/nano-4.6-117-1-x86_64.eopkg", key)
+	if err = other.Save(path + DetachedSuffix); err != nil {
+		t.Fatalf("Failed to save signature: %v", err)
+	}
+	if _, err = OpenSigned(path, keyring); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("Expected ErrBadSignature, got: %v", err)
+	}
+}
+
+func TestSignatureEmbedded(t *testing.T) {
+	key, keyring := testKey(t)
+	path := copyPackage(t)
+	sig := signPackage(t, path, key)
+	pkg, err := Open(path)
+	if err != nil {
+		t.Fatalf("Error opening valid .eopkg file: %v", err)
+	}
+	defer pkg.Close()
+	signed := filepath.Join(t.TempDir(), "signed.eopkg")
+	if err = pkg.WriteSigned(signed, sig); err != nil {
+		t.Fatalf("Failed to embed signature: %v", err)
+	}
+	spkg, err := OpenSigned(signed, keyring)
+	if err != nil {
+		t.Fatalf("Failed to open signed package: %v", err)
+	}
+	defer spkg.Close()
+	if problems, err := spkg.CheckIntegrity(); err != nil || len(problems) != 0 {
+		t.Fatalf("Signed package is no longer intact: %v %v", problems, err)
+	}
+	// A forged signature value must be refused
+	sig.Value = base64.StdEncoding.EncodeToString(make([]byte, ed25519.SignatureSize))
+	if err = pkg.WriteSigned(signed, sig); err != nil {
+		t.Fatalf("Failed to embed signature: %v", err)
+	}
+	if _, err = OpenSigned(signed, keyring); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("Expected ErrBadSignature, got: %v", err)
+	}
+}
+
+func TestRequireSignature(t *testing.T) {
+	key, keyring := testKey(t)
+	path := copyPackage(t)
+	pkg, err := Open(path)
+	if err != nil {
+		t.Fatalf("Error opening valid .eopkg file: %v", err)
+	}
+	defer pkg.Close()
+	signed := filepath.Join(t.TempDir(), "signed.eopkg")
+	if err = pkg.WriteSigned(signed, signPackage(t, path, key)); err != nil {
+		t.Fatalf("Failed to embed signature: %v", err)
+	}
+	for name, file := range map[string]string{"signed": signed, "unsigned": path} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Failed to read package: %v", err)
+		}
+		mem, err := OpenBytes(data)
+		if err != nil {
+			t.Fatalf("Failed to open %s package from memory: %v", name, err)
+		}
+		err = mem.RequireSignature(keyring)
+		if name == "signed" && err != nil {
+			t.Fatalf("Signed package should be accepted: %v", err)
+		}
+		if name == "unsigned" && (err != ErrUnsigned || mem.zipFile != nil) {
+			t.Fatalf("Unsigned package should be refused and closed: %v", err)
+		}
+		mem.Close()
+	}
+}
+
+func TestSignatureNotInDelta(t *testing.T) {
+	key, _ := testKey(t)
+	pkg, err := Open(deltaNewPkg)
+	if err != nil {
+		t.Fatalf("Error opening valid .eopkg file: %v", err)
+	}
+	defer pkg.Close()
+	sig, err := pkg.Sign(key)
+	if err != nil {
+		t.Fatalf("Failed to sign package: %v", err)
+	}
+	signed := filepath.Join(t.TempDir(), filepath.Base(deltaNewPkg))
+	if err = pkg.WriteSigned(signed, sig); err != nil {
+		t.Fatalf("Failed to embed signature: %v", err)
+	}
+	var paths []string
+	for _, format := range []DeltaFormat{DeltaFull, DeltaBinary} {
+		producer, err := NewDeltaProducer(t.TempDir(), deltaOldPkg, signed)
+		if err != nil {
+			t.Fatalf("Failed to create delta producer: %v", err)
+		}
+		defer producer.Close()
+		producer.Format = format
+		path, err := producer.Create()
+		if err != nil {
+			t.Fatalf("Failed to produce delta: %v", err)
+		}
+		paths = append(paths, path)
+	}
+	batch, err := NewBatchDeltaProducer(t.TempDir(), signed)
+	if err != nil {
+		t.Fatalf("Failed to create batch producer: %v", err)
+	}
+	defer batch.Close()
+	result := batch.Create([]string{deltaOldPkg})[0]
+	if result.Err != nil {
+		t.Fatalf("Failed to produce delta: %v", result.Err)
+	}
+	paths = append(paths, result.Path)
+	for _, path := range paths {
+		delta, err := Open(path)
+		if err != nil {
+			t.Fatalf("Error opening delta: %v", err)
+		}
+		defer delta.Close()
+		if delta.FindFile(SignatureFile) != nil {
+			t.Fatalf("Delta '%s' carries the signature of the full package", path)
+		}
+	}
+}
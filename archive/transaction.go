@@ -0,0 +1,407 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+var (
+	// ErrTransactionPending is returned when a previous install was interrupted,
+	// and must be finished or rolled back before another can begin
+	ErrTransactionPending = errors.New("An interrupted install must be recovered first")
+
+	// ErrStagingIncomplete is returned when finishing an install that was
+	// interrupted before the package was fully staged. It is rolled back instead.
+	ErrStagingIncomplete = errors.New("Install was interrupted while staging")
+)
+
+// StagingSuffix is appended to the install root to name the default staging area
+const StagingSuffix = ".eopkg-staging"
+
+// journalFile is the name of the journal within the staging area
+const journalFile = "journal.xml"
+
+// JournalState is the progress of an install transaction
+type JournalState string
+
+const (
+	// JournalStaging means the package is being extracted, and nothing outside
+	// of the staging area has been touched
+	JournalStaging JournalState = "staging"
+	// JournalCommitting means files are being renamed into place
+	JournalCommitting JournalState = "committing"
+	// JournalCommitted means every file is in place, and only the staging area
+	// needs to be removed
+	JournalCommitted JournalState = "committed"
+)
+
+// JournalEntry is a single rename from the staging area into place
+type JournalEntry struct {
+	// Source is relative to the staging area
+	Source string
+	// Target is absolute
+	Target string
+}
+
+// Journal records an install transaction, so that it can be recovered.
+//
+// The progress of each entry is not recorded, as it can be worked out from
+// the disk: the staged file only goes once it has been renamed into place, and
+// a backup only exists once the original has been moved aside.
+type Journal struct {
+	XMLName xml.Name `xml:"Journal"`
+	State   JournalState
+	// Dir lists the directories created in the root, parents first
+	Dir   []string
+	Entry []JournalEntry
+}
+
+// Transaction installs a package by extracting it into a staging area next to
+// the root, and only then renaming each file into place. Any file that is
+// replaced is backed up until the install has finished.
+//
+// The staging area and metadata directory must be on the same filesystem as
+// the root, so that files can be renamed into place.
+type Transaction struct {
+	// Root is where the files are installed
+	Root string
+	// Meta is where 'files.xml' and 'metadata.xml' are installed
+	Meta string
+	// Staging is the directory used while installing
+	Staging string
+	// Options are used to unpack into the staging area
+	Options UnpackOptions
+}
+
+// NewTransaction creates a transaction for installing into root, staging
+// next to it
+func NewTransaction(metaPath, root string) *Transaction {
+	return &Transaction{
+		Root:    root,
+		Meta:    metaPath,
+		Staging: filepath.Clean(root) + StagingSuffix,
+	}
+}
+
+// journalPath is the location of the journal
+func (t *Transaction) journalPath() string {
+	return filepath.Join(t.Staging, journalFile)
+}
+
+// backupPath is the location of the backup for an entry
+func (t *Transaction) backupPath(index int) string {
+	return filepath.Join(t.Staging, "backup", strconv.Itoa(index))
+}
+
+// Pending checks if an interrupted install needs to be recovered
+func (t *Transaction) Pending() (bool, error) {
+	_, err := os.Lstat(t.journalPath())
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// readJournal loads the journal of an interrupted install
+func (t *Transaction) readJournal() (j *Journal, err error) {
+	j = &Journal{}
+	xmlFile, err := os.Open(t.journalPath())
+	if err != nil {
+		return
+	}
+	defer xmlFile.Close()
+	dec := xml.NewDecoder(xmlFile)
+	err = dec.Decode(j)
+	return
+}
+
+// writeJournal atomically replaces the journal
+func (t *Transaction) writeJournal(j *Journal) error {
+	tmp := t.journalPath() + ".new"
+	xmlFile, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(xmlFile)
+	enc.Indent("", "    ")
+	if err = enc.Encode(j); err == nil {
+		err = xmlFile.Sync()
+	}
+	if cerr := xmlFile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, t.journalPath()); err != nil {
+		return err
+	}
+	return syncDir(t.Staging)
+}
+
+// syncDir makes a rename within dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Install extracts the archive into the staging area, then renames each file
+// into place. If anything goes wrong while renaming, the install is rolled
+// back. If the process dies instead, the journal is left for Finish or
+// Rollback to recover.
+func (t *Transaction) Install(a *Archive) error {
+	pending, err := t.Pending()
+	if err != nil {
+		return err
+	}
+	if pending {
+		return ErrTransactionPending
+	}
+	j, err := t.stage(a)
+	if err != nil {
+		return t.abort(err)
+	}
+	for i := range j.Entry {
+		if err = t.commitEntry(j, i); err != nil {
+			return t.abort(err)
+		}
+	}
+	return t.cleanup(j)
+}
+
+// abort rolls back a failed install, returning the original error
+func (t *Transaction) abort(err error) error {
+	if rerr := t.Rollback(); rerr != nil && !os.IsNotExist(rerr) {
+		return fmt.Errorf("%w, and rollback failed: %v", err, rerr)
+	}
+	os.RemoveAll(t.Staging)
+	return err
+}
+
+// stage extracts the archive into the staging area, and works out every
+// rename needed to install it
+func (t *Transaction) stage(a *Archive) (*Journal, error) {
+	// Clear out anything left behind before the journal was first written
+	if err := os.RemoveAll(t.Staging); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(t.Staging, "backup"), 0700); err != nil {
+		return nil, err
+	}
+	j := &Journal{State: JournalStaging}
+	if err := t.writeJournal(j); err != nil {
+		return nil, err
+	}
+	if err := a.UnpackWith(filepath.Join(t.Staging, "meta"), filepath.Join(t.Staging, "files"), t.Options); err != nil {
+		return nil, err
+	}
+	if err := a.ReadFiles(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(t.Meta, 0755); err != nil {
+		return nil, err
+	}
+	root, err := filepath.Abs(t.Root)
+	if err != nil {
+		return nil, err
+	}
+	created := make(map[string]bool)
+	for _, file := range a.Files.File {
+		source := filepath.Join("files", file.Path)
+		info, err := os.Lstat(filepath.Join(t.Staging, source))
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is missing from the install tarball: %w", file.Path, err)
+		}
+		target := filepath.Join(root, file.Path)
+		if info.IsDir() {
+			if err = t.missingDirs(j, root, target, created); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err = t.missingDirs(j, root, filepath.Dir(target), created); err != nil {
+			return nil, err
+		}
+		j.Entry = append(j.Entry, JournalEntry{Source: source, Target: target})
+	}
+	// Metadata goes in last, so it is only replaced once the files are
+	meta, err := filepath.Abs(t.Meta)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"files.xml", "metadata.xml", OwnershipFile} {
+		source := filepath.Join("meta", name)
+		if _, err = os.Lstat(filepath.Join(t.Staging, source)); os.IsNotExist(err) {
+			continue
+		}
+		j.Entry = append(j.Entry, JournalEntry{Source: source, Target: filepath.Join(meta, name)})
+	}
+	j.State = JournalCommitting
+	if err = t.writeJournal(j); err != nil {
+		return nil, err
+	}
+	// Directories are created before anything else can depend on them
+	for _, dir := range j.Dir {
+		if err = t.createDir(root, dir); err != nil {
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+// missingDirs adds dir and any of its parents which don't exist in the root
+// to the journal, parents first
+func (t *Transaction) missingDirs(j *Journal, root, dir string, created map[string]bool) error {
+	if dir == root || created[dir] {
+		return nil
+	}
+	if _, err := os.Lstat(dir); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := t.missingDirs(j, root, filepath.Dir(dir), created); err != nil {
+		return err
+	}
+	created[dir] = true
+	j.Dir = append(j.Dir, dir)
+	return nil
+}
+
+// createDir makes a directory in the root, copying the mode and ownership of
+// the staged copy
+func (t *Transaction) createDir(root, dir string) error {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(filepath.Join(t.Staging, "files", rel))
+	if err != nil {
+		return err
+	}
+	if err = os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	stat := info.Sys().(*syscall.Stat_t)
+	if err = os.Lchown(dir, int(stat.Uid), int(stat.Gid)); err != nil && !t.Options.Rootless {
+		return err
+	}
+	return os.Chmod(dir, info.Mode()&(os.ModePerm|os.ModeSetgid|os.ModeSticky))
+}
+
+// commitEntry moves any existing file aside, then renames the staged file
+// into place. It is safe to repeat after an interruption.
+func (t *Transaction) commitEntry(j *Journal, index int) error {
+	entry := j.Entry[index]
+	source := filepath.Join(t.Staging, entry.Source)
+	if _, err := os.Lstat(source); os.IsNotExist(err) {
+		// Already renamed into place
+		return nil
+	}
+	backup := t.backupPath(index)
+	if _, err := os.Lstat(backup); os.IsNotExist(err) {
+		if err = os.Rename(entry.Target, backup); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(source, entry.Target)
+}
+
+// rollbackEntry puts back whatever was at the target before the install
+func (t *Transaction) rollbackEntry(j *Journal, index int) error {
+	entry := j.Entry[index]
+	backup := t.backupPath(index)
+	if _, err := os.Lstat(backup); err == nil {
+		return os.Rename(backup, entry.Target)
+	}
+	if _, err := os.Lstat(filepath.Join(t.Staging, entry.Source)); os.IsNotExist(err) {
+		// Installed where there was nothing before
+		if err = os.Remove(entry.Target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanup marks the install as finished, and discards the staging area along
+// with every backup
+func (t *Transaction) cleanup(j *Journal) error {
+	j.State = JournalCommitted
+	if err := t.writeJournal(j); err != nil {
+		return err
+	}
+	return os.RemoveAll(t.Staging)
+}
+
+// Finish completes an interrupted install, renaming the rest of the files into
+// place. An install interrupted while staging cannot be finished, so it is
+// rolled back and ErrStagingIncomplete is returned.
+func (t *Transaction) Finish() error {
+	j, err := t.readJournal()
+	if err != nil {
+		return err
+	}
+	switch j.State {
+	case JournalStaging:
+		if err = os.RemoveAll(t.Staging); err != nil {
+			return err
+		}
+		return ErrStagingIncomplete
+	case JournalCommitting:
+		for i := range j.Entry {
+			if err = t.commitEntry(j, i); err != nil {
+				return err
+			}
+		}
+	}
+	return t.cleanup(j)
+}
+
+// Rollback undoes an interrupted install, restoring every file that was
+// replaced and removing every file and directory that was added
+func (t *Transaction) Rollback() error {
+	j, err := t.readJournal()
+	if err != nil {
+		return err
+	}
+	if j.State == JournalCommitted {
+		// Too late to go back
+		return os.RemoveAll(t.Staging)
+	}
+	for i := len(j.Entry) - 1; i >= 0; i-- {
+		if err = t.rollbackEntry(j, i); err != nil {
+			return err
+		}
+	}
+	for i := len(j.Dir) - 1; i >= 0; i-- {
+		if err = os.Remove(j.Dir[i]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.RemoveAll(t.Staging)
+}
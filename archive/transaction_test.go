@@ -0,0 +1,115 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// prepareRoot creates an install root with an old copy of nano in place
+func prepareRoot(t *testing.T) (*Transaction, *Archive) {
+	pkg, err := Open(eopkgTestFile)
+	if err != nil {
+		t.Fatalf("Error opening valid .eopkg file: %v", err)
+	}
+	t.Cleanup(func() { pkg.Close() })
+	dir := t.TempDir()
+	tx := NewTransaction(filepath.Join(dir, "meta"), filepath.Join(dir, "root"))
+	if err = os.MkdirAll(filepath.Join(tx.Root, "usr/bin"), 0755); err != nil {
+		t.Fatalf("Failed to create root: %v", err)
+	}
+	if err = os.WriteFile(filepath.Join(tx.Root, "usr/bin/nano"), []byte("old"), 0755); err != nil {
+		t.Fatalf("Failed to write old file: %v", err)
+	}
+	return tx, pkg
+}
+
+// interrupt stages the package and renames only some of the files into
+// place, as though the process died part way through
+func interrupt(t *testing.T, tx *Transaction, pkg *Archive) {
+	j, err := tx.stage(pkg)
+	if err != nil {
+		t.Fatalf("Failed to stage package: %v", err)
+	}
+	for i := 0; i < len(j.Entry)/2; i++ {
+		if err = tx.commitEntry(j, i); err != nil {
+			t.Fatalf("Failed to commit %s: %v", j.Entry[i].Target, err)
+		}
+	}
+	if pending, err := tx.Pending(); err != nil || !pending {
+		t.Fatalf("Interrupted install should be pending: %v", err)
+	}
+	if err = tx.Install(pkg); err != ErrTransactionPending {
+		t.Fatalf("Expected ErrTransactionPending, got: %v", err)
+	}
+}
+
+// checkStagingRemoved ensures nothing was left behind
+func checkStagingRemoved(t *testing.T, tx *Transaction) {
+	if _, err := os.Lstat(tx.Staging); !os.IsNotExist(err) {
+		t.Fatalf("Staging area was not removed")
+	}
+}
+
+func TestTransactionInstall(t *testing.T) {
+	tx, pkg := prepareRoot(t)
+	if err := tx.Install(pkg); err != nil {
+		t.Fatalf("Failed to install: %v", err)
+	}
+	if err := pkg.Verify(tx.Root); err != nil {
+		t.Fatalf("Verification failed: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(tx.Meta, "files.xml")); err != nil {
+		t.Fatalf("Metadata was not installed: %v", err)
+	}
+	checkStagingRemoved(t, tx)
+}
+
+func TestTransactionRollback(t *testing.T) {
+	tx, pkg := prepareRoot(t)
+	interrupt(t, tx, pkg)
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Failed to roll back: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(tx.Root, "usr/bin/nano"))
+	if err != nil || string(data) != "old" {
+		t.Fatalf("Replaced file was not restored: %v", err)
+	}
+	for _, name := range []string{"usr/bin/rnano", "usr/share"} {
+		if _, err = os.Lstat(filepath.Join(tx.Root, name)); !os.IsNotExist(err) {
+			t.Fatalf("Installed %s was not removed", name)
+		}
+	}
+	if _, err = os.Lstat(filepath.Join(tx.Meta, "files.xml")); !os.IsNotExist(err) {
+		t.Fatalf("Metadata should not be installed")
+	}
+	checkStagingRemoved(t, tx)
+}
+
+func TestTransactionFinish(t *testing.T) {
+	tx, pkg := prepareRoot(t)
+	interrupt(t, tx, pkg)
+	if err := tx.Finish(); err != nil {
+		t.Fatalf("Failed to finish: %v", err)
+	}
+	if err := pkg.Verify(tx.Root); err != nil {
+		t.Fatalf("Verification failed: %v", err)
+	}
+	checkStagingRemoved(t, tx)
+}
@@ -0,0 +1,510 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+var (
+	// ErrUnsafePath is matched by every UnsafePathError, for use with errors.Is
+	ErrUnsafePath = errors.New("Unsafe path in package")
+
+	// ErrUnsupportedEntry is returned for a tar entry type that eopkg can never produce
+	ErrUnsupportedEntry = errors.New("Unsupported tar entry type")
+)
+
+// sparseBlockSize is the granularity at which holes are restored in sparse files
+const sparseBlockSize = 4096
+
+// UnsafePathError is returned when an entry in the install tarball would be
+// written outside of the install root
+type UnsafePathError struct {
+	// Name of the offending tar entry
+	Name string
+	// Target of a link entry, when that is the problem
+	Target string
+	// Reason the entry was rejected
+	Reason string
+}
+
+// Error describes the offending entry
+func (e *UnsafePathError) Error() string {
+	if e.Target != "" {
+		return fmt.Sprintf("unsafe path '%s' -> '%s': %s", e.Name, e.Target, e.Reason)
+	}
+	return fmt.Sprintf("unsafe path '%s': %s", e.Name, e.Reason)
+}
+
+// Unwrap allows errors.Is(err, ErrUnsafePath)
+func (e *UnsafePathError) Unwrap() error {
+	return ErrUnsafePath
+}
+
+// unpacker extracts tar entries, confined to a single root directory.
+//
+// Every name is resolved as though root were "/", so a symlink extracted
+// earlier may be traversed, but can never lead outside of the root. The final
+// component of a name is never followed, so an existing symlink is replaced
+// rather than written through.
+//
+// Directories are left writable until finish, so that a read-only directory
+// can still be filled, and its time is not changed by what is written inside.
+type unpacker struct {
+	root      string
+	opts      UnpackOptions
+	ownership *Ownership
+	dirs      []pendingDir
+}
+
+// pendingDir is a directory whose attributes are applied by finish
+type pendingDir struct {
+	dst    string
+	header *tar.Header
+}
+
+// newUnpacker prepares to extract into root
+func newUnpacker(root string, opts UnpackOptions) (*unpacker, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	u := &unpacker{root: abs, opts: opts}
+	if opts.sidecar() {
+		u.ownership = &Ownership{}
+	}
+	return u, nil
+}
+
+// cleanEntryName validates a name from the tarball, rejecting anything that
+// is absolute or refers to a parent directory
+func cleanEntryName(name, target string) (string, error) {
+	check := name
+	if target != "" {
+		check = target
+	}
+	if path.IsAbs(check) {
+		return "", &UnsafePathError{Name: name, Target: target, Reason: "absolute path"}
+	}
+	for _, part := range strings.Split(check, "/") {
+		if part == ".." {
+			return "", &UnsafePathError{Name: name, Target: target, Reason: "parent directory reference"}
+		}
+	}
+	clean := path.Clean(check)
+	if clean == "." {
+		clean = ""
+	}
+	return clean, nil
+}
+
+// resolve maps a tar entry name to its location on disk. The parent
+// directories are resolved through any symlinks, but the final component is
+// left untouched.
+func (u *unpacker) resolve(name, target string) (string, error) {
+	rel, err := cleanEntryName(name, target)
+	if err != nil {
+		return "", err
+	}
+	if rel == "" {
+		return u.root, nil
+	}
+	parent, err := u.resolveDir(name, path.Dir(rel))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, path.Base(rel)), nil
+}
+
+// resolveDir follows every symlink in dir, treating absolute targets as
+// relative to the root and clamping ".." at the root, just like a chroot
+func (u *unpacker) resolveDir(name, dir string) (string, error) {
+	parts := strings.Split(dir, "/")
+	resolved := ""
+	hops := 0
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if resolved = path.Dir(resolved); resolved == "." {
+				resolved = ""
+			}
+			continue
+		}
+		next := path.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(u.root, next))
+		if err != nil {
+			if os.IsNotExist(err) {
+				resolved = next
+				continue
+			}
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if hops++; hops > maxSymlinkHops {
+			return "", &UnsafePathError{Name: name, Reason: ErrSymlinkLoop.Error()}
+		}
+		link, err := os.Readlink(filepath.Join(u.root, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(link) {
+			resolved = ""
+		}
+		parts = append(strings.Split(link, "/"), parts...)
+	}
+	return filepath.Join(u.root, resolved), nil
+}
+
+// prepare makes the parent directories of dst, and removes anything already
+// at dst unless the new entry is a directory and a directory is already there.
+// An existing symlink to a directory is kept, like tar's
+// --keep-directory-symlink, in which case keep is set.
+func (u *unpacker) prepare(name, dst string, dir bool) (keep bool, err error) {
+	if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return
+	}
+	info, err := os.Lstat(dst)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return
+	}
+	if dir && info.IsDir() {
+		return false, nil
+	}
+	if dir && info.Mode()&os.ModeSymlink != 0 {
+		// Only follow the link within the root
+		rel, _ := cleanEntryName(name, "")
+		if resolved, rerr := u.resolveDir(name, rel); rerr == nil {
+			if target, serr := os.Stat(resolved); serr == nil && target.IsDir() {
+				return true, nil
+			}
+		}
+	}
+	return false, os.Remove(dst)
+}
+
+// extract writes out a single entry from the tarball
+func (u *unpacker) extract(header *tar.Header, src io.Reader) error {
+	dst, err := u.resolve(header.Name, "")
+	if err != nil {
+		return err
+	}
+	keep, err := u.prepare(header.Name, dst, header.Typeflag == tar.TypeDir)
+	if err != nil || keep {
+		return err
+	}
+	mode := header.FileInfo().Mode()
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeCont:
+		err = writeFile(dst, src, isSparse(header), header.Size)
+	case tar.TypeGNUSparse:
+		err = writeFile(dst, src, true, header.Size)
+	case tar.TypeLink:
+		// Hardlinks are relative to the root, not to the link
+		var target string
+		if target, err = u.resolve(header.Name, header.Linkname); err != nil {
+			return err
+		}
+		if err = os.Link(target, dst); err != nil || u.ownership == nil {
+			return err
+		}
+		return u.record(dst, header)
+	case tar.TypeSymlink:
+		err = os.Symlink(header.Linkname, dst)
+	case tar.TypeDir:
+		if err = os.Mkdir(dst, 0755); os.IsExist(err) {
+			err = nil
+		}
+		if err == nil {
+			u.dirs = append(u.dirs, pendingDir{dst: dst, header: header})
+			return nil
+		}
+	case tar.TypeFifo:
+		err = unix.Mkfifo(dst, 0600)
+	case tar.TypeChar, tar.TypeBlock:
+		if u.opts.Rootless {
+			return u.recordDevice(header)
+		}
+		kind := uint32(unix.S_IFCHR)
+		if header.Typeflag == tar.TypeBlock {
+			kind = unix.S_IFBLK
+		}
+		err = mknod(dst, kind, header)
+	default:
+		return fmt.Errorf("'%s' has type %q: %w", header.Name, header.Typeflag, ErrUnsupportedEntry)
+	}
+	if err != nil {
+		return err
+	}
+	return u.applyAttributes(dst, header, mode)
+}
+
+// finish applies the attributes of every directory, deepest first, like tar
+// restoring directories last. It must be called once every entry is extracted.
+func (u *unpacker) finish() error {
+	sort.SliceStable(u.dirs, func(i, j int) bool {
+		return strings.Count(u.dirs[i].dst, "/") > strings.Count(u.dirs[j].dst, "/")
+	})
+	for _, dir := range u.dirs {
+		if err := u.applyAttributes(dir.dst, dir.header, dir.header.FileInfo().Mode()); err != nil {
+			return err
+		}
+	}
+	u.dirs = nil
+	return nil
+}
+
+// isSparse checks for the PAX records of a GNU sparse file
+func isSparse(header *tar.Header) bool {
+	for key := range header.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// mknod creates a device node, with permissions applied later
+func mknod(dst string, kind uint32, header *tar.Header) error {
+	dev := unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))
+	return unix.Mknod(dst, kind|0600, int(dev))
+}
+
+// writeFile creates a new file, refusing to follow a symlink. Sparse files
+// have any blocks of zeroes skipped over, to restore their holes.
+func writeFile(dst string, src io.Reader, sparse bool, size int64) error {
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL|unix.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	if sparse {
+		err = copySparse(f, src, size)
+	} else {
+		_, err = io.Copy(f, src)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// copySparse writes out every block that isn't all zeroes, seeking past the
+// rest, and then sets the final size in case the file ends with a hole
+func copySparse(f *os.File, src io.Reader, size int64) error {
+	block := make([]byte, sparseBlockSize)
+	for {
+		n, err := io.ReadFull(src, block)
+		if n > 0 {
+			var werr error
+			if isZero(block[:n]) {
+				_, werr = f.Seek(int64(n), io.SeekCurrent)
+			} else {
+				_, werr = f.Write(block[:n])
+			}
+			if werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return f.Truncate(size)
+}
+
+// isZero checks if a block contains nothing but zeroes
+func isZero(block []byte) bool {
+	for _, b := range block {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// owner determines the ownership to apply to an entry, and whether to apply
+// it at all
+func (u *unpacker) owner(header *tar.Header) (uid, gid int, chown bool, err error) {
+	uid, gid = header.Uid, header.Gid
+	if u.opts.IDMap == nil {
+		return uid, gid, !u.opts.Rootless, nil
+	}
+	var ok bool
+	if uid, ok = mapID(u.opts.IDMap.UIDs, header.Uid); !ok {
+		return 0, 0, false, fmt.Errorf("'%s' has UID %d: %w", header.Name, header.Uid, ErrUnmappedID)
+	}
+	if gid, ok = mapID(u.opts.IDMap.GIDs, header.Gid); !ok {
+		return 0, 0, false, fmt.Errorf("'%s' has GID %d: %w", header.Name, header.Gid, ErrUnmappedID)
+	}
+	return uid, gid, true, nil
+}
+
+// applyAttributes sets the ownership, permissions, times and xattrs of an
+// extracted entry, never following a symlink. Anything which is skipped or
+// remapped is recorded for the sidecar.
+func (u *unpacker) applyAttributes(dst string, header *tar.Header, mode os.FileMode) error {
+	uid, gid, chown, err := u.owner(header)
+	if err != nil {
+		return err
+	}
+	if chown {
+		if err = os.Lchown(dst, uid, gid); err != nil {
+			return err
+		}
+	}
+	// Symlinks have no permissions of their own, and a chown clears any
+	// setuid bits, so the mode must be applied afterwards
+	if header.Typeflag != tar.TypeSymlink {
+		if err := os.Chmod(dst, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+	}
+	times := []unix.Timespec{
+		{Nsec: unix.UTIME_OMIT},
+		unix.NsecToTimespec(header.ModTime.UnixNano()),
+	}
+	if !header.AccessTime.IsZero() {
+		times[0] = unix.NsecToTimespec(header.AccessTime.UnixNano())
+	}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, dst, times, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return err
+	}
+	if !u.opts.Rootless {
+		if err := setXattrs(dst, header.PAXRecords); err != nil {
+			return err
+		}
+	}
+	if u.ownership == nil {
+		return nil
+	}
+	return u.record(dst, header)
+}
+
+// newEntry records the attributes the package intended for an entry
+func (u *unpacker) newEntry(header *tar.Header) *OwnershipEntry {
+	name, _ := cleanEntryName(header.Name, "")
+	entry := &OwnershipEntry{
+		Path: name,
+		UID:  header.Uid,
+		GID:  header.Gid,
+		Mode: FileMode(header.Mode & 07777),
+	}
+	if u.opts.Rootless {
+		entry.Xattr = skippedXattrs(header.PAXRecords)
+	}
+	return entry
+}
+
+// record adds an extracted entry to the sidecar, along with the ownership
+// it actually has on disk
+func (u *unpacker) record(dst string, header *tar.Header) error {
+	info, err := os.Lstat(dst)
+	if err != nil {
+		return err
+	}
+	stat := info.Sys().(*syscall.Stat_t)
+	entry := u.newEntry(header)
+	entry.HostUID, entry.HostGID = int(stat.Uid), int(stat.Gid)
+	u.ownership.Entry = append(u.ownership.Entry, entry)
+	return nil
+}
+
+// recordDevice adds a device node to the sidecar in place of creating it
+func (u *unpacker) recordDevice(header *tar.Header) error {
+	entry := u.newEntry(header)
+	entry.Device = &Device{Type: "char", Major: header.Devmajor, Minor: header.Devminor}
+	if header.Typeflag == tar.TypeBlock {
+		entry.Device.Type = "block"
+	}
+	u.ownership.Entry = append(u.ownership.Entry, entry)
+	return nil
+}
+
+// setXattrs, applies Xattrs to a file, as they are stored in `tar.Header.PAXRecords`
+func setXattrs(path string, paxattrs map[string]string) error {
+	for attr, value := range paxattrs {
+		if !strings.HasPrefix(attr, "SCHILY.xattr.") {
+			continue
+		}
+		name := strings.TrimPrefix(attr, "SCHILY.xattr.")
+		if err := unix.Lsetxattr(path, name, []byte(value), 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unpackTarball extracts the install tarball into root, returning the
+// ownership sidecar if the options need one
+func (a *Archive) unpackTarball(root string, opts UnpackOptions) (*Ownership, error) {
+	u, err := newUnpacker(root, opts)
+	if err != nil {
+		return nil, err
+	}
+	// Decompress the tarball straight out of the zip container
+	f, err := a.openPayload()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	src := tar.NewReader(f)
+	// Iterate over tarball contents
+	for {
+		header, err := src.Next()
+		if err == io.EOF {
+			if err = u.finish(); err != nil {
+				return nil, err
+			}
+			return u.ownership, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Global PAX headers only describe the entries that follow
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		if err = u.extract(header, src); err != nil {
+			return nil, err
+		}
+	}
+}
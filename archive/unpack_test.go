@@ -0,0 +1,596 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/getsolus/libeopkg/shared"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// craftedMetadata is the least metadata.xml that can be read back
+const craftedMetadata = `<PISI>
+    <Source>
+        <Name>crafted</Name>
+    </Source>
+    <Package>
+        <Name>crafted</Name>
+        <Summary>Crafted package</Summary>
+        <Description>Crafted package for testing</Description>
+        <History>
+            <Update release="1">
+                <Version>1</Version>
+            </Update>
+        </History>
+    </Package>
+</PISI>`
+
+// testEntry is a single member of a crafted install tarball
+type testEntry struct {
+	header tar.Header
+	body   string
+	// raw PAX records, including any that tar.Writer refuses to write
+	pax map[string]string
+}
+
+// regEntry creates a regular file entry
+func regEntry(name, body string) testEntry {
+	return testEntry{
+		header: tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(body)), ModTime: time.Unix(1577836800, 0)},
+		body:   body,
+	}
+}
+
+// linkEntry creates a symlink or hardlink entry
+func linkEntry(kind byte, name, target string) testEntry {
+	return testEntry{
+		header: tar.Header{Typeflag: kind, Name: name, Linkname: target, Mode: 0777, ModTime: time.Unix(1577836800, 0)},
+	}
+}
+
+// payloadPAX writes a raw PAX extended header block for the next entry
+func payloadPAX(w io.Writer, name string, records map[string]string) {
+	var data bytes.Buffer
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		// The length prefix includes itself
+		record := fmt.Sprintf(" %s=%s\n", key, records[key])
+		size := len(record)
+		for len(strconv.Itoa(size))+len(record) != size {
+			size = len(strconv.Itoa(size)) + len(record)
+		}
+		fmt.Fprintf(&data, "%d%s", size, record)
+	}
+	block := make([]byte, 512)
+	copy(block[0:100], "PaxHeaders/"+path.Base(name))
+	copy(block[100:108], "0000644\x00")
+	copy(block[108:116], "0000000\x00")
+	copy(block[116:124], "0000000\x00")
+	copy(block[124:136], fmt.Sprintf("%011o\x00", data.Len()))
+	copy(block[136:148], fmt.Sprintf("%011o\x00", 0))
+	block[156] = tar.TypeXHeader
+	copy(block[257:265], "ustar\x0000")
+	copy(block[148:156], "        ")
+	sum := 0
+	for _, b := range block {
+		sum += int(b)
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	w.Write(block)
+	w.Write(data.Bytes())
+	w.Write(make([]byte, (512-data.Len()%512)%512))
+}
+
+// craftPackage builds a minimal .eopkg in memory from the given tarball entries
+func craftPackage(t *testing.T, entries ...testEntry) *Archive {
+	return craftPackageFiles(t, "<Files></Files>", entries...)
+}
+
+// craftPackageFiles is craftPackage, with the given files.xml
+func craftPackageFiles(t *testing.T, files string, entries ...testEntry) *Archive {
+	var payload bytes.Buffer
+	xw, err := shared.NewXzWriter(&payload, shared.CompressOptions{Level: 0, Threads: 1})
+	if err != nil {
+		t.Fatalf("Failed to create compressor: %v", err)
+	}
+	tw := tar.NewWriter(xw)
+	for _, entry := range entries {
+		header := entry.header
+		if entry.pax != nil {
+			if err = tw.Flush(); err != nil {
+				t.Fatalf("Failed to flush tarball: %v", err)
+			}
+			payloadPAX(xw, header.Name, entry.pax)
+		}
+		if err = tw.WriteHeader(&header); err != nil {
+			t.Fatalf("Failed to write header for %s: %v", header.Name, err)
+		}
+		if _, err = tw.Write([]byte(entry.body)); err != nil {
+			t.Fatalf("Failed to write %s: %v", header.Name, err)
+		}
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatalf("Failed to finish tarball: %v", err)
+	}
+	if err = xw.Close(); err != nil {
+		t.Fatalf("Failed to finish compression: %v", err)
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	members := map[string][]byte{
+		"metadata.xml":   []byte(craftedMetadata),
+		"files.xml":      []byte(files),
+		"install.tar.xz": payload.Bytes(),
+	}
+	for _, name := range []string{"metadata.xml", "files.xml", "install.tar.xz"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+		if _, err = w.Write(members[name]); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatalf("Failed to finish package: %v", err)
+	}
+	pkg, err := OpenBytes(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to open crafted package: %v", err)
+	}
+	return pkg
+}
+
+// unpackCrafted extracts a crafted package into a fresh root
+func unpackCrafted(t *testing.T, entries ...testEntry) (root string, err error) {
+	return unpackWith(t, UnpackOptions{}, entries...)
+}
+
+// unpackWith extracts a crafted package into a fresh root with the given options
+func unpackWith(t *testing.T, opts UnpackOptions, entries ...testEntry) (root string, err error) {
+	pkg := craftPackage(t, entries...)
+	defer pkg.Close()
+	dir := t.TempDir()
+	root = filepath.Join(dir, "root")
+	err = pkg.UnpackWith(filepath.Join(dir, "meta"), root, opts)
+	return
+}
+
+func TestUnpackParentEscape(t *testing.T) {
+	for _, name := range []string{"../evil", "usr/../../evil", "usr/lib/../../../evil"} {
+		_, err := unpackCrafted(t, regEntry(name, "evil"))
+		var unsafe *UnsafePathError
+		if !errors.As(err, &unsafe) || !errors.Is(err, ErrUnsafePath) {
+			t.Fatalf("Expected UnsafePathError for %s, got: %v", name, err)
+		}
+		if unsafe.Name != name {
+			t.Fatalf("Error should name the entry %s, got %s", name, unsafe.Name)
+		}
+	}
+}
+
+func TestUnpackAbsolute(t *testing.T) {
+	outside := filepath.Join(t.TempDir(), "evil")
+	if _, err := unpackCrafted(t, regEntry(outside, "evil")); !errors.Is(err, ErrUnsafePath) {
+		t.Fatalf("Expected UnsafePathError for absolute name, got: %v", err)
+	}
+	if _, err := os.Lstat(outside); !os.IsNotExist(err) {
+		t.Fatalf("Absolute entry was written outside of the root")
+	}
+}
+
+func TestUnpackSymlinkEscape(t *testing.T) {
+	outside := t.TempDir()
+	root, err := unpackCrafted(t,
+		linkEntry(tar.TypeSymlink, "usr/abs", outside),
+		regEntry("usr/abs/pwned", "abs"),
+		linkEntry(tar.TypeSymlink, "usr/rel", "../../../../../../.."),
+		regEntry("usr/rel/pwned", "rel"),
+	)
+	if err != nil {
+		t.Fatalf("Failed to unpack: %v", err)
+	}
+	if _, err = os.Lstat(filepath.Join(outside, "pwned")); !os.IsNotExist(err) {
+		t.Fatalf("Absolute symlink was followed outside of the root")
+	}
+	// Both links must resolve as though the root were "/"
+	expected := map[string]string{
+		filepath.Join(root, outside, "pwned"): "abs",
+		filepath.Join(root, "pwned"):          "rel",
+	}
+	for path, body := range expected {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Expected file within the root at %s: %v", path, err)
+		}
+		if string(data) != body {
+			t.Fatalf("Incorrect contents at %s: %s", path, data)
+		}
+	}
+}
+
+func TestUnpackSymlinkReplace(t *testing.T) {
+	outside := filepath.Join(t.TempDir(), "target")
+	if err := os.WriteFile(outside, []byte("original"), 0644); err != nil {
+		t.Fatalf("Failed to write target: %v", err)
+	}
+	root, err := unpackCrafted(t,
+		linkEntry(tar.TypeSymlink, "usr/file", outside),
+		regEntry("usr/file", "safe"),
+	)
+	if err != nil {
+		t.Fatalf("Failed to unpack: %v", err)
+	}
+	if data, _ := os.ReadFile(outside); string(data) != "original" {
+		t.Fatalf("Regular file was written through a symlink: %s", data)
+	}
+	info, err := os.Lstat(filepath.Join(root, "usr/file"))
+	if err != nil {
+		t.Fatalf("Failed to stat replaced file: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		t.Fatalf("Symlink should have been replaced by a regular file: %v", info.Mode())
+	}
+}
+
+func TestUnpackHardlinkEscape(t *testing.T) {
+	for _, target := range []string{"../../etc/passwd", "/etc/passwd"} {
+		_, err := unpackCrafted(t, linkEntry(tar.TypeLink, "usr/passwd", target))
+		var unsafe *UnsafePathError
+		if !errors.As(err, &unsafe) {
+			t.Fatalf("Expected UnsafePathError for hardlink to %s, got: %v", target, err)
+		}
+		if unsafe.Target != target {
+			t.Fatalf("Error should name the target %s, got %s", target, unsafe.Target)
+		}
+	}
+}
+
+func TestUnpackDevices(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Creating device nodes requires root")
+	}
+	root, err := unpackCrafted(t,
+		testEntry{header: tar.Header{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0666, Devmajor: 1, Devminor: 3}},
+		testEntry{header: tar.Header{Typeflag: tar.TypeBlock, Name: "dev/loop0", Mode: 0660, Devmajor: 7, Devminor: 0}},
+	)
+	if err != nil {
+		t.Fatalf("Failed to unpack devices: %v", err)
+	}
+	devices := map[string]struct {
+		mode         os.FileMode
+		major, minor uint32
+	}{
+		"dev/null":  {os.ModeDevice | os.ModeCharDevice | 0666, 1, 3},
+		"dev/loop0": {os.ModeDevice | 0660, 7, 0},
+	}
+	for name, expected := range devices {
+		info, err := os.Lstat(filepath.Join(root, name))
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", name, err)
+		}
+		if info.Mode() != expected.mode {
+			t.Fatalf("Incorrect mode for %s: %v", name, info.Mode())
+		}
+		rdev := uint64(info.Sys().(*syscall.Stat_t).Rdev)
+		if major, minor := unix.Major(rdev), unix.Minor(rdev); major != expected.major || minor != expected.minor {
+			t.Fatalf("Incorrect device for %s: %d:%d", name, major, minor)
+		}
+	}
+}
+
+func TestUnpackFifo(t *testing.T) {
+	root, err := unpackCrafted(t, testEntry{header: tar.Header{Typeflag: tar.TypeFifo, Name: "run/pipe", Mode: 0620}})
+	if err != nil {
+		t.Fatalf("Failed to unpack fifo: %v", err)
+	}
+	info, err := os.Lstat(filepath.Join(root, "run/pipe"))
+	if err != nil {
+		t.Fatalf("Failed to stat fifo: %v", err)
+	}
+	if info.Mode() != os.ModeNamedPipe|0620 {
+		t.Fatalf("Incorrect mode for fifo: %v", info.Mode())
+	}
+}
+
+func TestUnpackHardlink(t *testing.T) {
+	root, err := unpackCrafted(t,
+		regEntry("usr/bin/python3.8", "python"),
+		linkEntry(tar.TypeLink, "usr/bin/python3", "usr/bin/python3.8"),
+	)
+	if err != nil {
+		t.Fatalf("Failed to unpack hardlink: %v", err)
+	}
+	target, err := os.Lstat(filepath.Join(root, "usr/bin/python3.8"))
+	if err != nil {
+		t.Fatalf("Failed to stat hardlink target: %v", err)
+	}
+	link, err := os.Lstat(filepath.Join(root, "usr/bin/python3"))
+	if err != nil {
+		t.Fatalf("Failed to stat hardlink: %v", err)
+	}
+	if !os.SameFile(target, link) {
+		t.Fatalf("Hardlink does not share the inode of its target")
+	}
+	if _, err = unpackCrafted(t, linkEntry(tar.TypeLink, "usr/bin/python3", "usr/bin/missing")); err == nil {
+		t.Fatalf("Hardlink to a missing target should fail")
+	}
+}
+
+func TestUnpackSparse(t *testing.T) {
+	const size = 1 << 20
+	root, err := unpackCrafted(t, testEntry{
+		header: tar.Header{Typeflag: tar.TypeReg, Name: "var/sparse", Mode: 0644, Size: 4, Format: tar.FormatPAX},
+		body:   "data",
+		pax: map[string]string{
+			"GNU.sparse.size":      strconv.Itoa(size),
+			"GNU.sparse.numblocks": "1",
+			"GNU.sparse.map":       "4096,4",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to unpack sparse file: %v", err)
+	}
+	dst := filepath.Join(root, "var/sparse")
+	data, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("Failed to read sparse file: %v", err)
+	}
+	if len(data) != size {
+		t.Fatalf("Incorrect size for sparse file: %d", len(data))
+	}
+	if string(data[4096:4100]) != "data" || !isZero(data[:4096]) || !isZero(data[4100:]) {
+		t.Fatalf("Incorrect contents for sparse file")
+	}
+	info, err := os.Lstat(dst)
+	if err != nil {
+		t.Fatalf("Failed to stat sparse file: %v", err)
+	}
+	if used := info.Sys().(*syscall.Stat_t).Blocks * 512; used >= size {
+		t.Fatalf("Sparse file has no holes, %d bytes allocated", used)
+	}
+}
+
+func TestUnpackLongNames(t *testing.T) {
+	long := "usr/share/" + strings.Repeat("very-long-directory-name/", 8) + "file.txt"
+	gnu := tar.Header{Typeflag: tar.TypeReg, Name: long + ".gnu", Mode: 0644, Size: 3, Format: tar.FormatGNU}
+	pax := tar.Header{Typeflag: tar.TypeReg, Name: long + ".pax", Mode: 0644, Size: 3, Format: tar.FormatPAX}
+	root, err := unpackCrafted(t,
+		testEntry{header: tar.Header{Typeflag: tar.TypeXGlobalHeader, Name: "global", PAXRecords: map[string]string{"comment": "crafted"}}},
+		testEntry{header: gnu, body: "gnu"},
+		testEntry{header: pax, body: "pax"},
+		linkEntry(tar.TypeSymlink, "usr/bin/long", "../../"+long+".gnu"),
+	)
+	if err != nil {
+		t.Fatalf("Failed to unpack long names: %v", err)
+	}
+	for _, suffix := range []string{"gnu", "pax"} {
+		data, err := os.ReadFile(filepath.Join(root, long+"."+suffix))
+		if err != nil {
+			t.Fatalf("Failed to read long %s name: %v", suffix, err)
+		}
+		if string(data) != suffix {
+			t.Fatalf("Incorrect contents for long %s name: %s", suffix, data)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "usr/bin/long")); err != nil || string(data) != "gnu" {
+		t.Fatalf("Failed to follow long symlink target: %v", err)
+	}
+	if _, err = os.Lstat(filepath.Join(root, "global")); !os.IsNotExist(err) {
+		t.Fatalf("Global PAX header should not be extracted")
+	}
+}
+
+func TestUnpackUnsupported(t *testing.T) {
+	_, err := unpackCrafted(t, testEntry{header: tar.Header{Typeflag: 'Z', Name: "usr/unknown", Mode: 0644}})
+	if !errors.Is(err, ErrUnsupportedEntry) {
+		t.Fatalf("Expected ErrUnsupportedEntry, got: %v", err)
+	}
+}
+
+func TestUnpackRootless(t *testing.T) {
+	owned := regEntry("usr/bin/owned", "owned")
+	owned.header.Uid, owned.header.Gid, owned.header.Mode = 1000, 100, 02755
+	owned.header.PAXRecords = map[string]string{"SCHILY.xattr.user.test": "\x00\x01"}
+	// Hardlinks carry the same attributes as their target
+	hardlink := linkEntry(tar.TypeLink, "usr/bin/hardlink", "usr/bin/owned")
+	hardlink.header.Uid, hardlink.header.Gid, hardlink.header.Mode = 1000, 100, 02755
+	pkg := craftPackage(t,
+		owned,
+		hardlink,
+		testEntry{header: tar.Header{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0666, Devmajor: 1, Devminor: 3}},
+	)
+	defer pkg.Close()
+	dir := t.TempDir()
+	meta, root := filepath.Join(dir, "meta"), filepath.Join(dir, "root")
+	if err := pkg.UnpackWith(meta, root, UnpackOptions{Rootless: true}); err != nil {
+		t.Fatalf("Failed to unpack rootless: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "dev/null")); !os.IsNotExist(err) {
+		t.Fatalf("Device node should not be created rootless")
+	}
+	if _, err := unix.Lgetxattr(filepath.Join(root, "usr/bin/owned"), "user.test", nil); err == nil {
+		t.Fatalf("Xattr should not be set rootless")
+	}
+	ownership, err := ReadOwnership(meta)
+	if err != nil {
+		t.Fatalf("Failed to read ownership sidecar: %v", err)
+	}
+	if len(ownership.Entry) != 3 {
+		t.Fatalf("Expected 3 sidecar entries, got %d", len(ownership.Entry))
+	}
+	for _, name := range []string{"usr/bin/owned", "usr/bin/hardlink"} {
+		entry := ownership.Find(name)
+		if entry == nil {
+			t.Fatalf("Missing sidecar entry for %s", name)
+		}
+		if entry.UID != 1000 || entry.GID != 100 || entry.Mode != 02755 {
+			t.Fatalf("Incorrect sidecar entry for %s: %d:%d %o", name, entry.UID, entry.GID, entry.Mode)
+		}
+		if entry.HostUID != os.Geteuid() {
+			t.Fatalf("Incorrect host UID for %s: %d", name, entry.HostUID)
+		}
+	}
+	xattrs, err := ownership.Find("usr/bin/owned").Xattrs()
+	if err != nil {
+		t.Fatalf("Failed to decode xattrs: %v", err)
+	}
+	if value := xattrs["user.test"]; string(value) != "\x00\x01" {
+		t.Fatalf("Incorrect xattr recorded: %q", value)
+	}
+	device := ownership.Find("dev/null")
+	if device == nil || device.Device == nil || *device.Device != (Device{Type: "char", Major: 1, Minor: 3}) {
+		t.Fatalf("Device node was not recorded")
+	}
+}
+
+func TestUnpackReadOnlyDir(t *testing.T) {
+	modTime := time.Unix(1577836800, 0)
+	dir := testEntry{header: tar.Header{Typeflag: tar.TypeDir, Name: "usr/share/ro/", Mode: 0555, ModTime: modTime}}
+	sub := testEntry{header: tar.Header{Typeflag: tar.TypeDir, Name: "usr/share/ro/sub/", Mode: 0555, ModTime: modTime}}
+	options := []UnpackOptions{{Rootless: true}}
+	if os.Geteuid() == 0 {
+		options = append(options, UnpackOptions{})
+	}
+	for _, opts := range options {
+		// Unprivileged, the files could not be written if the mode was
+		// applied first, and as root the times would be overwritten
+		root, err := unpackWith(t, opts, dir, regEntry("usr/share/ro/file", "file"), sub, regEntry("usr/share/ro/sub/file", "file"))
+		t.Cleanup(func() {
+			os.Chmod(filepath.Join(root, "usr/share/ro/sub"), 0755)
+			os.Chmod(filepath.Join(root, "usr/share/ro"), 0755)
+		})
+		if err != nil {
+			t.Fatalf("Failed to unpack read-only directory: %v", err)
+		}
+		for _, name := range []string{"usr/share/ro", "usr/share/ro/sub"} {
+			info, err := os.Lstat(filepath.Join(root, name))
+			if err != nil {
+				t.Fatalf("Failed to stat %s: %v", name, err)
+			}
+			if info.Mode().Perm() != 0555 || !info.ModTime().Equal(modTime) {
+				t.Fatalf("Incorrect attributes for %s: %v %v", name, info.Mode(), info.ModTime())
+			}
+		}
+	}
+}
+
+func TestUnpackIDMap(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Remapping ownership requires root")
+	}
+	owned := regEntry("usr/bin/owned", "owned")
+	owned.header.Uid, owned.header.Gid = 1000, 100
+	pkg := craftPackage(t, owned)
+	defer pkg.Close()
+	dir := t.TempDir()
+	idmap := &IDMap{
+		UIDs: []IDMapping{{ID: 0, HostID: 100000, Size: 65536}},
+		GIDs: []IDMapping{{ID: 0, HostID: 200000, Size: 65536}},
+	}
+	if err := pkg.UnpackWith(filepath.Join(dir, "meta"), filepath.Join(dir, "root"), UnpackOptions{IDMap: idmap}); err != nil {
+		t.Fatalf("Failed to unpack with ID map: %v", err)
+	}
+	info, err := os.Lstat(filepath.Join(dir, "root/usr/bin/owned"))
+	if err != nil {
+		t.Fatalf("Failed to stat remapped file: %v", err)
+	}
+	if stat := info.Sys().(*syscall.Stat_t); stat.Uid != 101000 || stat.Gid != 200100 {
+		t.Fatalf("Incorrect remapped ownership: %d:%d", stat.Uid, stat.Gid)
+	}
+	idmap.UIDs[0].Size = 1000
+	_, err = unpackWith(t, UnpackOptions{IDMap: idmap}, owned)
+	if !errors.Is(err, ErrUnmappedID) {
+		t.Fatalf("Expected ErrUnmappedID, got: %v", err)
+	}
+}
+
+func TestVerifyRootless(t *testing.T) {
+	pkg, err := Open(eopkgTestFile)
+	if err != nil {
+		t.Fatalf("Error opening valid .eopkg file: %v", err)
+	}
+	defer pkg.Close()
+	dir := t.TempDir()
+	meta, root := filepath.Join(dir, "meta"), filepath.Join(dir, "root")
+	if err = pkg.UnpackWith(meta, root, UnpackOptions{Rootless: true}); err != nil {
+		t.Fatalf("Failed to unpack rootless: %v", err)
+	}
+	ownership, err := ReadOwnership(meta)
+	if err != nil {
+		t.Fatalf("Failed to read ownership sidecar: %v", err)
+	}
+	if err = pkg.VerifyWith(root, VerifyOptions{Ownership: ownership}); err != nil {
+		t.Fatalf("Verification failed: %v", err)
+	}
+	ownership.Find("usr/bin/nano").UID = 1000
+	if err = pkg.VerifyWith(root, VerifyOptions{Ownership: ownership}); err == nil {
+		t.Fatalf("Verification should fail for a mismatched sidecar")
+	}
+}
+
+func TestVerifyRootlessDevice(t *testing.T) {
+	files := `<Files>
+    <File>
+        <Path>dev/null</Path>
+        <Type>data</Type>
+        <Mode>0666</Mode>
+    </File>
+</Files>`
+	pkg := craftPackageFiles(t, files,
+		testEntry{header: tar.Header{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0666, Devmajor: 1, Devminor: 3}},
+	)
+	defer pkg.Close()
+	dir := t.TempDir()
+	meta, root := filepath.Join(dir, "meta"), filepath.Join(dir, "root")
+	if err := pkg.UnpackWith(meta, root, UnpackOptions{Rootless: true}); err != nil {
+		t.Fatalf("Failed to unpack rootless: %v", err)
+	}
+	ownership, err := ReadOwnership(meta)
+	if err != nil {
+		t.Fatalf("Failed to read ownership sidecar: %v", err)
+	}
+	if err = pkg.VerifyWith(root, VerifyOptions{Ownership: ownership}); err != nil {
+		t.Fatalf("Recorded device node should verify: %v", err)
+	}
+	ownership.Find("dev/null").Mode = 0600
+	report, err := pkg.CheckWith(root, VerifyOptions{Ownership: ownership})
+	if err != nil {
+		t.Fatalf("Failed to check: %v", err)
+	}
+	if problems := report.Problems(); len(problems) != 1 || problems[0].Kind != ProblemMode {
+		t.Fatalf("Expected a mode problem for the recorded device, got: %v", problems)
+	}
+}
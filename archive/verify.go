@@ -0,0 +1,375 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// ErrNoOwnership is returned when the ownership sidecar has no entry for a file
+var ErrNoOwnership = errors.New("No ownership recorded")
+
+// ProblemKind is a machine-readable category of verification failure
+type ProblemKind string
+
+const (
+	// ProblemMissing means the file does not exist
+	ProblemMissing ProblemKind = "missing"
+	// ProblemUnreadable means the file could not be inspected at all
+	ProblemUnreadable ProblemKind = "unreadable"
+	// ProblemSize means the file has the wrong size
+	ProblemSize ProblemKind = "size"
+	// ProblemMode means the file has the wrong permissions
+	ProblemMode ProblemKind = "mode"
+	// ProblemOwner means the file has the wrong UID or GID
+	ProblemOwner ProblemKind = "owner"
+	// ProblemHash means the contents of a regular file have changed
+	ProblemHash ProblemKind = "hash"
+	// ProblemSymlink means a symlink points somewhere else. Expected is the
+	// hash of the target in files.xml, or the target itself when comparing
+	// two payloads.
+	ProblemSymlink ProblemKind = "symlink"
+	// ProblemType means an entry in the install tarball is the wrong type
+	ProblemType ProblemKind = "type"
+	// ProblemUnlisted means an entry in the install tarball is not in files.xml
+	ProblemUnlisted ProblemKind = "unlisted"
+	// ProblemUndeclared means a COMAR script is not declared in Provides
+	ProblemUndeclared ProblemKind = "undeclared"
+)
+
+// Problem is a single way in which a file on disk differs from the package
+type Problem struct {
+	// Path of the file, as listed in files.xml
+	Path string
+	// Kind of problem
+	Kind ProblemKind
+	// Expected value, as listed in files.xml
+	Expected string
+	// Actual value, as found on disk
+	Actual string
+	// Err is set when the file could not be inspected
+	Err error
+}
+
+// Error describes the problem
+func (p *Problem) Error() string {
+	switch {
+	case p.Err != nil:
+		return fmt.Sprintf("'%s' %s: %v", p.Path, p.Kind, p.Err)
+	case p.Kind == ProblemSymlink:
+		return fmt.Sprintf("'%s' symlink target '%s' does not match %s", p.Path, p.Actual, p.Expected)
+	case p.Kind == ProblemMissing:
+		return fmt.Sprintf("'%s' is missing", p.Path)
+	case p.Kind == ProblemUnlisted:
+		return fmt.Sprintf("'%s' is not listed in files.xml", p.Path)
+	case p.Kind == ProblemUndeclared:
+		return fmt.Sprintf("'%s' is not declared in Provides", p.Path)
+	}
+	return fmt.Sprintf("'%s' %s mismatch: %s != %s", p.Path, p.Kind, p.Actual, p.Expected)
+}
+
+// Unwrap gives access to the underlying error, if there is one
+func (p *Problem) Unwrap() error {
+	return p.Err
+}
+
+// FileResult is the outcome of verifying a single file
+type FileResult struct {
+	File     *File
+	Problems []*Problem
+}
+
+// OK checks if the file had no problems
+func (r *FileResult) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// add records a new problem with this file
+func (r *FileResult) add(kind ProblemKind, expected, actual string) {
+	r.Problems = append(r.Problems, &Problem{Path: r.File.Path, Kind: kind, Expected: expected, Actual: actual})
+}
+
+// fail records a problem that stopped this file from being inspected
+func (r *FileResult) fail(kind ProblemKind, err error) *FileResult {
+	r.Problems = append(r.Problems, &Problem{Path: r.File.Path, Kind: kind, Err: err})
+	return r
+}
+
+// err returns the first problem with the file, or nil if there were none
+func (r *FileResult) err() error {
+	if r.OK() {
+		return nil
+	}
+	return r.Problems[0]
+}
+
+// Report is the outcome of verifying every file in a package, with one
+// result per file in the order of files.xml
+type Report struct {
+	Files []*FileResult
+}
+
+// OK checks if every file was verified without problems
+func (r *Report) OK() bool {
+	for _, result := range r.Files {
+		if !result.OK() {
+			return false
+		}
+	}
+	return true
+}
+
+// Problems lists every problem in the report
+func (r *Report) Problems() (problems []*Problem) {
+	for _, result := range r.Files {
+		problems = append(problems, result.Problems...)
+	}
+	return
+}
+
+// ByKind groups every problem in the report by its kind
+func (r *Report) ByKind() map[ProblemKind][]*Problem {
+	kinds := make(map[ProblemKind][]*Problem)
+	for _, problem := range r.Problems() {
+		kinds[problem.Kind] = append(kinds[problem.Kind], problem)
+	}
+	return kinds
+}
+
+// Err returns the first problem in the report, or nil if there were none
+func (r *Report) Err() error {
+	for _, result := range r.Files {
+		if err := result.err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// problemKinds lists every kind of problem, for stable output
+var problemKinds = []ProblemKind{
+	ProblemMissing, ProblemUnreadable, ProblemSize, ProblemMode, ProblemOwner, ProblemHash, ProblemSymlink,
+	ProblemType, ProblemUnlisted, ProblemUndeclared,
+}
+
+// String summarises the report, with a count for each kind of problem
+func (r *Report) String() string {
+	kinds := r.ByKind()
+	var counts []string
+	for _, kind := range problemKinds {
+		if n := len(kinds[kind]); n > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", n, kind))
+		}
+	}
+	if len(counts) == 0 {
+		return fmt.Sprintf("%d files OK", len(r.Files))
+	}
+	return fmt.Sprintf("%d files, problems: %s", len(r.Files), strings.Join(counts, ", "))
+}
+
+// VerifyOptions control how Verify checks the files on disk
+type VerifyOptions struct {
+	// Ownership is the sidecar from a rootless or remapped Unpack. When set,
+	// ownership is checked against it rather than directly against the disk.
+	Ownership *Ownership
+	// Workers is the number of files checked at once, defaulting to the
+	// number of CPUs
+	Workers int
+	// Progress is called as each file is checked, in order of completion.
+	// Calls are never concurrent.
+	Progress func(result *FileResult, done, total int)
+}
+
+// workers is the number of workers to use, with a sensible default
+func (o VerifyOptions) workers() int {
+	if o.Workers < 1 {
+		return runtime.NumCPU()
+	}
+	return o.Workers
+}
+
+// Check inspects the copy of this file on disk, reporting every problem
+func (f *File) Check(path string) *FileResult {
+	return f.check(path, f.UID, f.GID, &FileResult{File: f})
+}
+
+// CheckOwnership is Check for a rootless or remapped Unpack. The ownership
+// recorded in the sidecar entry must match this file, and the disk must
+// match the ownership the entry says was actually applied. A device node
+// that was recorded rather than created is only checked against the entry.
+func (f *File) CheckOwnership(path string, entry *OwnershipEntry) *FileResult {
+	result := &FileResult{File: f}
+	if entry == nil {
+		return result.fail(ProblemOwner, ErrNoOwnership)
+	}
+	if entry.UID != f.UID || entry.GID != f.GID {
+		result.add(ProblemOwner, ownerString(f.UID, f.GID), ownerString(entry.UID, entry.GID)+" (recorded)")
+	}
+	if entry.Mode != f.Mode {
+		result.add(ProblemMode, modeString(f.Mode), modeString(entry.Mode)+" (recorded)")
+	}
+	if entry.Device != nil {
+		// Device nodes are only recorded, never created, so there is nothing
+		// on disk to check
+		if entry.Device.Type != "char" && entry.Device.Type != "block" {
+			result.add(ProblemType, "char or block device", entry.Device.Type+" (recorded)")
+		}
+		if entry.Device.Major < 0 || entry.Device.Minor < 0 {
+			result.add(ProblemType, "device number", fmt.Sprintf("%d:%d (recorded)", entry.Device.Major, entry.Device.Minor))
+		}
+		return result
+	}
+	return f.check(path, entry.HostUID, entry.HostGID, result)
+}
+
+// ownerString formats ownership as uid:gid
+func ownerString(uid, gid int) string {
+	return fmt.Sprintf("%d:%d", uid, gid)
+}
+
+// modeString formats permissions in octal
+func modeString(mode FileMode) string {
+	return fmt.Sprintf("%04o", uint32(mode))
+}
+
+// check inspects the file on disk, expecting it to be owned by uid and gid
+func (f *File) check(path string, uid, gid int, result *FileResult) *FileResult {
+	dstPath := filepath.Join(path, f.Path)
+	info, err := os.Lstat(dstPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result.fail(ProblemMissing, err)
+		}
+		return result.fail(ProblemUnreadable, err)
+	}
+	if sz := info.Size(); sz != f.Size {
+		result.add(ProblemSize, fmt.Sprint(f.Size), fmt.Sprint(sz))
+	}
+	if m := info.Mode().Perm(); m != f.FileMode() {
+		result.add(ProblemMode, modeString(f.Mode), modeString(FileMode(m)))
+	}
+	stat := info.Sys().(*syscall.Stat_t)
+	if stat.Uid != uint32(uid) || stat.Gid != uint32(gid) {
+		result.add(ProblemOwner, ownerString(uid, gid), ownerString(int(stat.Uid), int(stat.Gid)))
+	}
+	mode := info.Mode()
+	if !mode.IsRegular() {
+		if (mode & os.ModeSymlink) != os.ModeSymlink {
+			return result
+		}
+		name, err := os.Readlink(dstPath)
+		if err != nil {
+			return result.fail(ProblemUnreadable, err)
+		}
+		if sum := fmt.Sprintf("%x", sha1.Sum([]byte(name))); sum != f.Hash {
+			result.add(ProblemSymlink, f.Hash, name)
+		}
+		return result
+	}
+	dst, err := os.Open(dstPath)
+	if err != nil {
+		return result.fail(ProblemUnreadable, err)
+	}
+	defer dst.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, dst); err != nil {
+		return result.fail(ProblemUnreadable, err)
+	}
+	if sum := fmt.Sprintf("%x", h.Sum(nil)); sum != f.Hash {
+		result.add(ProblemHash, f.Hash, sum)
+	}
+	return result
+}
+
+// Check inspects every file on disk against the archive, reporting every
+// problem rather than stopping at the first
+func (a *Archive) Check(path string) (*Report, error) {
+	return a.CheckWith(path, VerifyOptions{})
+}
+
+// CheckWith is Check, but with control over how files are checked
+func (a *Archive) CheckWith(path string, opts VerifyOptions) (*Report, error) {
+	return a.CheckContext(context.Background(), path, opts)
+}
+
+// CheckContext is CheckWith, but stops early if ctx is cancelled. Files are
+// checked concurrently, but the report is always in the order of files.xml.
+func (a *Archive) CheckContext(ctx context.Context, path string, opts VerifyOptions) (*Report, error) {
+	if err := a.ReadAll(); err != nil {
+		return nil, err
+	}
+	var owners map[string]*OwnershipEntry
+	if opts.Ownership != nil {
+		owners = opts.Ownership.byPath()
+	}
+	total := len(a.Files.File)
+	report := &Report{Files: make([]*FileResult, total)}
+	jobs := make(chan int)
+	results := make(chan int)
+	// Feed the workers until every file is queued, or the check is cancelled
+	go func() {
+		defer close(jobs)
+		for i := range a.Files.File {
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for w := 0; w < opts.workers(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				file := a.Files.File[i]
+				if owners == nil {
+					report.Files[i] = file.Check(path)
+				} else {
+					report.Files[i] = file.CheckOwnership(path, owners[file.Path])
+				}
+				results <- i
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	done := 0
+	for i := range results {
+		done++
+		if opts.Progress != nil {
+			opts.Progress(report.Files[i], done, total)
+		}
+	}
+	if done < total {
+		return nil, ctx.Err()
+	}
+	return report, nil
+}
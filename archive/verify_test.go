@@ -0,0 +1,146 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// unpackNano extracts the test package into a fresh root
+func unpackNano(t *testing.T) (*Archive, string) {
+	pkg, err := Open(eopkgTestFile)
+	if err != nil {
+		t.Fatalf("Error opening valid .eopkg file: %v", err)
+	}
+	t.Cleanup(func() { pkg.Close() })
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	if err = pkg.Unpack(filepath.Join(dir, "meta"), root); err != nil {
+		t.Fatalf("Could not unpack .eopkg file: %v", err)
+	}
+	return pkg, root
+}
+
+func TestCheckClean(t *testing.T) {
+	pkg, root := unpackNano(t)
+	report, err := pkg.Check(root)
+	if err != nil {
+		t.Fatalf("Failed to check: %v", err)
+	}
+	if !report.OK() || report.Err() != nil {
+		t.Fatalf("Clean install has problems: %s", report)
+	}
+	if len(report.Files) != len(pkg.Files.File) {
+		t.Fatalf("Expected a result for each of %d files, got %d", len(pkg.Files.File), len(report.Files))
+	}
+}
+
+func TestCheckReport(t *testing.T) {
+	pkg, root := unpackNano(t)
+	damage := []error{
+		os.Remove(filepath.Join(root, "usr/share/nano/c.nanorc")),
+		os.WriteFile(filepath.Join(root, "usr/share/nano/sh.nanorc"), []byte("changed"), 0644),
+		os.Chmod(filepath.Join(root, "usr/bin/nano"), 0700),
+		os.Lchown(filepath.Join(root, "usr/share/nano/go.nanorc"), 1000, 1000),
+		os.Remove(filepath.Join(root, "usr/bin/rnano")),
+		os.Symlink("pico", filepath.Join(root, "usr/bin/rnano")),
+	}
+	for _, err := range damage {
+		if err != nil {
+			t.Fatalf("Failed to damage install: %v", err)
+		}
+	}
+	report, err := pkg.Check(root)
+	if err != nil {
+		t.Fatalf("Failed to check: %v", err)
+	}
+	expected := map[ProblemKind]string{
+		ProblemMissing: "usr/share/nano/c.nanorc",
+		ProblemSize:    "usr/share/nano/sh.nanorc",
+		ProblemHash:    "usr/share/nano/sh.nanorc",
+		ProblemMode:    "usr/bin/nano",
+		ProblemOwner:   "usr/share/nano/go.nanorc",
+		ProblemSymlink: "usr/bin/rnano",
+	}
+	if os.Geteuid() != 0 {
+		delete(expected, ProblemOwner)
+	}
+	kinds := report.ByKind()
+	for kind, path := range expected {
+		if len(kinds[kind]) != 1 || kinds[kind][0].Path != path {
+			t.Fatalf("Expected a single %s problem for %s, got %v", kind, path, kinds[kind])
+		}
+	}
+	problems := report.Problems()
+	if len(problems) != len(expected) {
+		t.Fatalf("Unexpected problems: %v", problems)
+	}
+	var problem *Problem
+	if err = pkg.Verify(root); !errors.As(err, &problem) || problem.Error() != problems[0].Error() {
+		t.Fatalf("Verify should fail on the first problem, got: %v", err)
+	}
+}
+
+func TestCheckParallel(t *testing.T) {
+	pkg, root := unpackNano(t)
+	if err := os.WriteFile(filepath.Join(root, "usr/bin/nano"), []byte("changed"), 0755); err != nil {
+		t.Fatalf("Failed to damage install: %v", err)
+	}
+	calls := 0
+	opts := VerifyOptions{
+		Workers: 4,
+		Progress: func(result *FileResult, done, total int) {
+			calls++
+			if done != calls || total != len(pkg.Files.File) {
+				t.Errorf("Unexpected progress: %d of %d", done, total)
+			}
+		},
+	}
+	report, err := pkg.CheckWith(root, opts)
+	if err != nil {
+		t.Fatalf("Failed to check: %v", err)
+	}
+	if calls != len(pkg.Files.File) {
+		t.Fatalf("Expected progress for each of %d files, got %d", len(pkg.Files.File), calls)
+	}
+	for i, result := range report.Files {
+		if result.File != pkg.Files.File[i] {
+			t.Fatalf("Result %d is for %s, expected %s", i, result.File.Path, pkg.Files.File[i].Path)
+		}
+	}
+	if problems := report.Problems(); len(problems) != 2 || problems[0].Path != "usr/bin/nano" {
+		t.Fatalf("Unexpected problems: %v", problems)
+	}
+}
+
+func TestCheckCancel(t *testing.T) {
+	pkg, root := unpackNano(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	opts := VerifyOptions{
+		Workers: 2,
+		Progress: func(result *FileResult, done, total int) {
+			cancel()
+		},
+	}
+	if _, err := pkg.CheckContext(ctx, root, opts); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got: %v", err)
+	}
+}
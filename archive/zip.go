@@ -0,0 +1,49 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package archive
+
+import (
+	"archive/zip"
+	"io"
+)
+
+// copyMembers duplicates the members of src into dst exactly as they are
+// stored, without decompressing them, except for any that skip matches. Only
+// the headers are normalised when r is set.
+func copyMembers(dst *zip.Writer, src *zip.Reader, skip func(f *zip.File) bool, r *Reproducible) error {
+	for _, f := range src.File {
+		if skip != nil && skip(f) {
+			continue
+		}
+		in, err := f.OpenRaw()
+		if err != nil {
+			return err
+		}
+		// Duplicate the header, which still describes the raw data
+		header := f.FileHeader
+		r.zipHeader(&header)
+		out, err := dst.CreateRaw(&header)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(out, in); err != nil {
+			return err
+		}
+	}
+	// flush to disk
+	return dst.Flush()
+}
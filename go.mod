@@ -1,3 +1,9 @@
 module github.com/getsolus/libeopkg
 
-go 1.12
+go 1.22
+
+require (
+	github.com/klauspost/compress v1.18.0
+	github.com/ulikunitz/xz v0.5.15
+	golang.org/x/sys v0.30.0
+)
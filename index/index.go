@@ -73,6 +73,11 @@ func hashFile(path string) error {
 
 // Save writes the index out to a file, compresses it, and then generates hash files for both files
 func (i *Index) Save(path string) error {
+	return i.SaveWith(path, shared.DefaultCompressOptions)
+}
+
+// SaveWith is Save, but with control over how the index is compressed
+func (i *Index) SaveWith(path string, opts shared.CompressOptions) error {
 	indexFile := filepath.Join(path, "eopkg-index.xml")
 	xmlFile, err := os.Create(indexFile)
 	if err != nil {
@@ -85,7 +90,7 @@ func (i *Index) Save(path string) error {
 		return err
 	}
 	xmlFile.Close()
-	if err = shared.XzFile(indexFile, true); err != nil {
+	if err = compressFile(indexFile, opts); err != nil {
 		return err
 	}
 	if err = hashFile(indexFile); err != nil {
@@ -93,3 +98,29 @@ func (i *Index) Save(path string) error {
 	}
 	return hashFile(indexFile + ".xz")
 }
+
+// compressFile writes an xz compressed copy of the file alongside it
+func compressFile(path string, opts shared.CompressOptions) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(path + ".xz")
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	xw, err := shared.NewXzWriter(dst, opts)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(xw, src); err != nil {
+		xw.Close()
+		return err
+	}
+	if err = xw.Close(); err != nil {
+		return err
+	}
+	return dst.Sync()
+}
@@ -0,0 +1,132 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pspec
+
+import (
+	"github.com/getsolus/libeopkg/archive"
+	"path"
+	"strings"
+)
+
+// Ambiguity is a file claimed equally by more than one package
+type Ambiguity struct {
+	// Path of the file, relative to the install root
+	Path string
+	// Packages which all have an equally specific Path for the file
+	Packages []string
+}
+
+// Split is the result of assigning staged files to packages
+type Split struct {
+	// Packages holds the files for each package by name, ready for
+	// archive.Builder, with the Type of each set from the matching Path
+	Packages map[string]*archive.Files
+	// Unmatched lists files that no package has a Path for
+	Unmatched []string
+	// Ambiguous lists files that could not be assigned to a single package
+	Ambiguous []Ambiguity
+}
+
+// OK checks if every file was assigned to exactly one package
+func (s *Split) OK() bool {
+	return len(s.Unmatched) == 0 && len(s.Ambiguous) == 0
+}
+
+// isGlob checks if a Path is a pattern, rather than a file or directory
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// Match checks if this Path covers a file, given as an absolute path. A
+// directory covers everything inside it, and a glob covers anything it
+// matches, along with everything inside anything it matches.
+//
+// The more specific the match, the higher the score, so that a subpackage
+// can claim files within a directory that belongs to another package.
+func (p Path) Match(file string) (score int, ok bool) {
+	pattern := path.Clean("/" + strings.TrimSpace(p.Value))
+	if !isGlob(pattern) {
+		if file == pattern || pattern == "/" || strings.HasPrefix(file, pattern+"/") {
+			return len(pattern), true
+		}
+		return 0, false
+	}
+	for dir := file; dir != "/"; dir = path.Dir(dir) {
+		if matched, _ := path.Match(pattern, dir); matched {
+			return len(pattern), true
+		}
+	}
+	return 0, false
+}
+
+// Split assigns the files staged in root to the packages, in the same way as
+// SplitFiles
+func (p *PSpec) Split(root string) (*Split, error) {
+	staged, err := archive.ListStaged(root)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, len(staged.File))
+	for i, file := range staged.File {
+		paths[i] = file.Path
+	}
+	return p.SplitFiles(paths), nil
+}
+
+// SplitFiles assigns each file, relative to the install root, to the package
+// with the most specific matching Path, like ypkg. A file matched by several
+// packages is only Ambiguous when their most specific matches are equally
+// specific, so /usr/share/doc wins over /usr/share without any ambiguity.
+func (p *PSpec) SplitFiles(paths []string) *Split {
+	split := &Split{Packages: make(map[string]*archive.Files)}
+	for _, pkg := range p.Packages {
+		split.Packages[pkg.Name] = &archive.Files{}
+	}
+	for _, name := range paths {
+		file := path.Clean("/" + name)
+		best := -1
+		var owners []string
+		var kind Path
+		for _, pkg := range p.Packages {
+			for _, rule := range pkg.Files {
+				score, ok := rule.Match(file)
+				if !ok || score < best {
+					continue
+				}
+				if score > best {
+					best, owners, kind = score, nil, rule
+				}
+				if len(owners) == 0 || owners[len(owners)-1] != pkg.Name {
+					owners = append(owners, pkg.Name)
+				}
+			}
+		}
+		switch len(owners) {
+		case 0:
+			split.Unmatched = append(split.Unmatched, name)
+		case 1:
+			files := split.Packages[owners[0]]
+			files.File = append(files.File, &archive.File{Path: name, Type: kind.Kind})
+		default:
+			split.Ambiguous = append(split.Ambiguous, Ambiguity{Path: name, Packages: owners})
+		}
+	}
+	for _, files := range split.Packages {
+		files.Reindex()
+	}
+	return split
+}
@@ -0,0 +1,135 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package pspec
+
+import (
+	"github.com/getsolus/libeopkg/archive"
+	"github.com/getsolus/libeopkg/shared"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const (
+	eopkg = "../testdata/nano-4.7-118-1-x86_64.eopkg"
+)
+
+func TestSplitNano(t *testing.T) {
+	p, err := Load(pspec)
+	if err != nil {
+		t.Fatalf("Should have loaded successfully: %s", err)
+	}
+	pkg, err := archive.OpenAll(eopkg)
+	if err != nil {
+		t.Fatalf("Should have opened the package: %s", err)
+	}
+	defer pkg.Close()
+	dir := t.TempDir()
+	root := filepath.Join(dir, "install")
+	if err = pkg.Unpack(dir, root); err != nil {
+		t.Fatalf("Should have unpacked the package: %s", err)
+	}
+	split, err := p.Split(root)
+	if err != nil {
+		t.Fatalf("Should have split the install root: %s", err)
+	}
+	// The pspec is from a slightly different build, so not everything is listed
+	listed := make(map[string]bool)
+	for _, path := range p.Packages[0].Files {
+		listed[path.Value[1:]] = true
+	}
+	var unlisted []string
+	types := make(map[string]shared.FileType)
+	for _, file := range pkg.Files.File {
+		types[file.Path] = file.Type
+		if !listed[file.Path] {
+			unlisted = append(unlisted, file.Path)
+		}
+	}
+	if !reflect.DeepEqual(split.Unmatched, unlisted) || len(split.Ambiguous) != 0 {
+		t.Fatalf("Only unlisted files should be unmatched, got %v, ambiguous %v", split.Unmatched, split.Ambiguous)
+	}
+	files := split.Packages["nano"].File
+	if len(files)+len(unlisted) != len(pkg.Files.File) {
+		t.Fatalf("Should have %d files, got %d", len(pkg.Files.File)-len(unlisted), len(files))
+	}
+	for _, file := range files {
+		if file.Type != types[file.Path] {
+			t.Fatalf("%s should be %s, got %s", file.Path, types[file.Path], file.Type)
+		}
+	}
+}
+
+func TestSplitRules(t *testing.T) {
+	p := &PSpec{Packages: []Package{
+		{Name: "foo", Files: []Path{
+			{Kind: shared.FileExecutable, Value: "/usr/bin"},
+			{Kind: shared.FileData, Value: "/usr/share"},
+		}},
+		{Name: "foo-devel", Files: []Path{
+			{Kind: shared.FileHeader, Value: "/usr/include"},
+			{Kind: shared.FileLibrary, Value: "/usr/lib64/lib*.so"},
+		}},
+		{Name: "foo-docs", Files: []Path{
+			{Kind: shared.FileDoc, Value: "/usr/share/doc"},
+			{Kind: shared.FileMan, Value: "/usr/share/man"},
+		}},
+		{Name: "foo-extra", Files: []Path{
+			{Kind: shared.FileMan, Value: "/usr/share/man"},
+		}},
+	}}
+	split := p.SplitFiles([]string{
+		"usr/bin/foo",
+		"usr/include/foo/foo.h",
+		"usr/lib64/libfoo.so",
+		"usr/lib64/libfoo.so.1",
+		"usr/share/doc/foo/README",
+		"usr/share/foo/data",
+		"usr/share/man/man1/foo.1",
+	})
+	expected := map[string][]archive.File{
+		"foo": {
+			{Path: "usr/bin/foo", Type: shared.FileExecutable},
+			{Path: "usr/share/foo/data", Type: shared.FileData},
+		},
+		"foo-devel": {
+			{Path: "usr/include/foo/foo.h", Type: shared.FileHeader},
+			{Path: "usr/lib64/libfoo.so", Type: shared.FileLibrary},
+		},
+		// Also matched by /usr/share, but /usr/share/doc is more specific
+		"foo-docs": {
+			{Path: "usr/share/doc/foo/README", Type: shared.FileDoc},
+		},
+		"foo-extra": nil,
+	}
+	for name, files := range expected {
+		var got []archive.File
+		for _, file := range split.Packages[name].File {
+			got = append(got, *file)
+		}
+		if !reflect.DeepEqual(got, files) {
+			t.Fatalf("%s should have %v, got %v", name, files, got)
+		}
+	}
+	if !reflect.DeepEqual(split.Unmatched, []string{"usr/lib64/libfoo.so.1"}) {
+		t.Fatalf("Should have one unmatched file, got %v", split.Unmatched)
+	}
+	ambiguous := []Ambiguity{{Path: "usr/share/man/man1/foo.1", Packages: []string{"foo-docs", "foo-extra"}}}
+	if !reflect.DeepEqual(split.Ambiguous, ambiguous) {
+		t.Fatalf("Should have one ambiguous file, got %v", split.Ambiguous)
+	}
+}
@@ -0,0 +1,205 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package shared
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz/lzma"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Codec identifies the compression format of an install tarball
+type Codec string
+
+const (
+	// CodecXz is the default format since eopkg replaced pisi
+	CodecXz Codec = "xz"
+	// CodecGzip is supported for old pisi packages
+	CodecGzip Codec = "gz"
+	// CodecBzip2 is supported for old pisi packages
+	CodecBzip2 Codec = "bz2"
+	// CodecLzma is the legacy .lzma format used by pisi before xz
+	CodecLzma Codec = "lzma"
+	// CodecZstd trades a little size for much faster installs
+	CodecZstd Codec = "zst"
+)
+
+// TarballPrefix is the name of every install tarball, before the extension
+const TarballPrefix = "install.tar"
+
+// ErrUnsupportedCodec is returned when a codec cannot be used with the
+// requested backend, or is not known at all
+var ErrUnsupportedCodec = errors.New("Unsupported compression format")
+
+// Codecs lists every known codec, in order of preference
+var Codecs = []Codec{CodecXz, CodecZstd, CodecGzip, CodecBzip2, CodecLzma}
+
+// Extension returns the file suffix for this codec, including the dot
+func (c Codec) Extension() string {
+	return "." + string(c)
+}
+
+// TarballName returns the name of an install tarball compressed with this codec
+func (c Codec) TarballName() string {
+	return TarballPrefix + c.Extension()
+}
+
+// CodecFromName determines the codec from the suffix of a filename
+func CodecFromName(name string) (Codec, bool) {
+	for _, c := range Codecs {
+		if strings.HasSuffix(name, c.Extension()) {
+			return c, true
+		}
+	}
+	// Historic alternative suffixes
+	switch {
+	case strings.HasSuffix(name, ".tgz"), strings.HasSuffix(name, ".gzip"):
+		return CodecGzip, true
+	case strings.HasSuffix(name, ".bzip2"):
+		return CodecBzip2, true
+	case strings.HasSuffix(name, ".zstd"):
+		return CodecZstd, true
+	}
+	return "", false
+}
+
+// codecMagic is the leading bytes of each self-identifying format
+var codecMagic = []struct {
+	codec Codec
+	magic []byte
+}{
+	{CodecXz, []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}},
+	{CodecZstd, []byte{0x28, 0xB5, 0x2F, 0xFD}},
+	{CodecGzip, []byte{0x1F, 0x8B}},
+	{CodecBzip2, []byte{'B', 'Z', 'h'}},
+}
+
+// DetectCodec determines the codec from the leading bytes of a stream. The
+// legacy lzma format has no magic number and is never detected.
+func DetectCodec(header []byte) (Codec, bool) {
+	for _, m := range codecMagic {
+		if bytes.HasPrefix(header, m.magic) {
+			return m.codec, true
+		}
+	}
+	return "", false
+}
+
+// SniffCodec peeks at the start of the input to detect its codec, returning
+// a reader which still yields the complete stream
+func SniffCodec(in io.Reader) (Codec, io.Reader, error) {
+	br := bufio.NewReader(in)
+	header, err := br.Peek(6)
+	if err != nil && err != io.EOF {
+		return "", br, err
+	}
+	c, ok := DetectCodec(header)
+	if !ok {
+		return "", br, ErrUnsupportedCodec
+	}
+	return c, br, nil
+}
+
+// NewReader will decompress the input using the given codec
+func NewReader(c Codec, in io.Reader, opts CompressOptions) (io.ReadCloser, error) {
+	threads := strconv.Itoa(opts.threads())
+	switch c {
+	case CodecXz:
+		return NewXzReader(in, opts)
+	case CodecGzip:
+		if opts.Backend == BackendExec {
+			return newExecReader(in, "gzip", "-d", "-c")
+		}
+		return gzip.NewReader(in)
+	case CodecBzip2:
+		if opts.Backend == BackendExec {
+			return newExecReader(in, "bzip2", "-d", "-c")
+		}
+		return ioutil.NopCloser(bzip2.NewReader(in)), nil
+	case CodecLzma:
+		if opts.Backend == BackendExec {
+			return newExecReader(in, "unlzma", "-c")
+		}
+		r, err := lzma.NewReader(in)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(r), nil
+	case CodecZstd:
+		if opts.Backend == BackendExec {
+			return newExecReader(in, "zstd", "-d", "-c", "-T"+threads)
+		}
+		d, err := zstd.NewReader(in, zstd.WithDecoderConcurrency(opts.threads()))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, ErrUnsupportedCodec
+}
+
+// NewWriter will compress everything written to it with the given codec.
+// Close must be called to flush the end of the stream.
+//
+// The native backend cannot write bzip2, so BackendExec must be used for it.
+func NewWriter(c Codec, out io.Writer, opts CompressOptions) (io.WriteCloser, error) {
+	level := opts.level()
+	threads := strconv.Itoa(opts.threads())
+	switch c {
+	case CodecXz:
+		return NewXzWriter(out, opts)
+	case CodecGzip:
+		if opts.Backend == BackendExec {
+			return newExecWriter(out, "gzip", "-c", "-n", "-"+strconv.Itoa(minLevel(level)))
+		}
+		return gzip.NewWriterLevel(out, level)
+	case CodecBzip2:
+		if opts.Backend == BackendExec {
+			return newExecWriter(out, "bzip2", "-c", "-"+strconv.Itoa(minLevel(level)))
+		}
+	case CodecLzma:
+		if opts.Backend == BackendExec {
+			return newExecWriter(out, "lzma", "-c", "-"+strconv.Itoa(level))
+		}
+		cfg := lzma.WriterConfig{DictCap: xzDictCaps[level]}
+		return cfg.NewWriter(out)
+	case CodecZstd:
+		if opts.Backend == BackendExec {
+			return newExecWriter(out, "zstd", "-c", "-q", "-"+strconv.Itoa(minLevel(level)), "-T"+threads)
+		}
+		return zstd.NewWriter(out,
+			zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(minLevel(level))),
+			zstd.WithEncoderConcurrency(opts.threads()))
+	}
+	return nil, ErrUnsupportedCodec
+}
+
+// minLevel is the level for tools which have no level 0
+func minLevel(level int) int {
+	if level < 1 {
+		return 1
+	}
+	return level
+}
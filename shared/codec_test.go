@@ -0,0 +1,112 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package shared
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"testing"
+)
+
+// codecRoundTrip compresses and decompresses data, checking the magic number
+func codecRoundTrip(t *testing.T, c Codec, data []byte, opts CompressOptions) {
+	var buf bytes.Buffer
+	w, err := NewWriter(c, &buf, opts)
+	if err != nil {
+		t.Fatalf("Failed to create %s writer: %v", c, err)
+	}
+	if _, err = w.Write(data); err != nil {
+		t.Fatalf("Failed to compress %s: %v", c, err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("Failed to finish %s: %v", c, err)
+	}
+	// lzma has no magic number, so can only be known by name
+	var in io.Reader = &buf
+	if c != CodecLzma {
+		detected, sniffed, err := SniffCodec(&buf)
+		if err != nil {
+			t.Fatalf("Failed to detect %s: %v", c, err)
+		}
+		if detected != c {
+			t.Fatalf("Detected %s as %s", c, detected)
+		}
+		in = sniffed
+	}
+	r, err := NewReader(c, in, CompressOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create %s reader: %v", c, err)
+	}
+	defer r.Close()
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Failed to decompress %s: %v", c, err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Round trip mismatch for %s", c)
+	}
+}
+
+func TestCodecsNative(t *testing.T) {
+	data := testPayload()
+	for _, c := range []Codec{CodecXz, CodecGzip, CodecLzma, CodecZstd} {
+		codecRoundTrip(t, c, data, CompressOptions{Level: 1, Threads: 2})
+	}
+	if _, err := NewWriter(CodecBzip2, &bytes.Buffer{}, CompressOptions{}); err != ErrUnsupportedCodec {
+		t.Fatalf("Native bzip2 compression should be unsupported, got: %v", err)
+	}
+}
+
+func TestCodecsExec(t *testing.T) {
+	data := testPayload()
+	tools := map[Codec]string{
+		CodecGzip:  "gzip",
+		CodecBzip2: "bzip2",
+		CodecZstd:  "zstd",
+	}
+	for c, tool := range tools {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Logf("Skipping %s, %s is not installed", c, tool)
+			continue
+		}
+		codecRoundTrip(t, c, data, CompressOptions{Level: 1, Threads: 2, Backend: BackendExec})
+	}
+}
+
+func TestCodecFromName(t *testing.T) {
+	names := map[string]Codec{
+		"install.tar.xz":   CodecXz,
+		"install.tar.gz":   CodecGzip,
+		"install.tar.bz2":  CodecBzip2,
+		"install.tar.lzma": CodecLzma,
+		"install.tar.zst":  CodecZstd,
+	}
+	for name, expected := range names {
+		c, ok := CodecFromName(name)
+		if !ok || c != expected {
+			t.Fatalf("Expected %s for %s, got %s", expected, name, c)
+		}
+		if c.TarballName() != name {
+			t.Fatalf("Expected tarball name %s, got %s", name, c.TarballName())
+		}
+	}
+	if _, ok := CodecFromName("install.tar"); ok {
+		t.Fatalf("Uncompressed tarball should not have a codec")
+	}
+}
@@ -0,0 +1,200 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package shared
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// Backend selects how compression and decompression are performed
+type Backend int
+
+const (
+	// BackendNative works entirely in-process, using pure Go implementations
+	BackendNative Backend = iota
+	// BackendExec shells out to the host tools, such as xz and unxz
+	BackendExec
+)
+
+// CompressOptions controls the behaviour of the compression layer
+type CompressOptions struct {
+	// Level is the compression preset, from 0 (fastest) to 9 (smallest)
+	Level int
+	// Threads is the number of concurrent compressors, values below 1 are
+	// treated as 1. With the native backend, more than one thread produces
+	// concatenated xz streams, which older pisi and eopkg may fail to read.
+	Threads int
+	// Backend is the implementation to use
+	Backend Backend
+}
+
+// DefaultCompressOptions matches the settings historically passed to the xz
+// tool, but without needing it installed on the host. A single thread keeps
+// the output to one stream that every reader accepts.
+var DefaultCompressOptions = CompressOptions{
+	Level:   6,
+	Threads: 1,
+	Backend: BackendNative,
+}
+
+// level returns the compression level, clamped to the valid range
+func (o CompressOptions) level() int {
+	switch {
+	case o.Level < 0:
+		return 0
+	case o.Level > 9:
+		return 9
+	}
+	return o.Level
+}
+
+// threads returns the number of threads, at least one
+func (o CompressOptions) threads() int {
+	if o.Threads < 1 {
+		return 1
+	}
+	return o.Threads
+}
+
+// ExecError is returned when a host tool used by BackendExec fails, and
+// carries whatever the tool wrote to stderr
+type ExecError struct {
+	Tool   string
+	Err    error
+	Stderr string
+}
+
+// Error formats the failure with the tool's own explanation
+func (e *ExecError) Error() string {
+	if e.Stderr == "" {
+		return fmt.Sprintf("%s failed: %v", e.Tool, e.Err)
+	}
+	return fmt.Sprintf("%s failed: %v: %s", e.Tool, e.Err, e.Stderr)
+}
+
+// Unwrap returns the underlying error from os/exec
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
+// execReader streams the output of a decompressor process
+type execReader struct {
+	out    io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+	waited bool
+}
+
+// newExecReader starts the given command with its stdin connected to in
+func newExecReader(in io.Reader, args ...string) (io.ReadCloser, error) {
+	r := &execReader{
+		cmd:    exec.Command(args[0], args[1:]...),
+		stderr: &bytes.Buffer{},
+	}
+	r.cmd.Stdin = in
+	r.cmd.Stderr = r.stderr
+	out, err := r.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	r.out = out
+	if err = r.cmd.Start(); err != nil {
+		return nil, &ExecError{Tool: args[0], Err: err}
+	}
+	return r, nil
+}
+
+// Read decompressed data, reporting any failure of the process at EOF
+func (r *execReader) Read(p []byte) (n int, err error) {
+	n, err = r.out.Read(p)
+	if err == io.EOF && !r.waited {
+		r.waited = true
+		if werr := r.cmd.Wait(); werr != nil {
+			err = r.wrap(werr)
+		}
+	}
+	return
+}
+
+// Close stops the process and waits for it to exit
+func (r *execReader) Close() error {
+	if r.waited {
+		return nil
+	}
+	r.waited = true
+	err := r.out.Close()
+	// The process may be killed by SIGPIPE if we stopped reading early
+	_ = r.cmd.Wait()
+	return err
+}
+
+// wrap adds the stderr output to an error from the process
+func (r *execReader) wrap(err error) error {
+	return &ExecError{
+		Tool:   r.cmd.Args[0],
+		Err:    err,
+		Stderr: strings.TrimSpace(r.stderr.String()),
+	}
+}
+
+// execWriter feeds a compressor process, which writes to the destination
+type execWriter struct {
+	in     io.WriteCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+// newExecWriter starts the given command with its stdout connected to out
+func newExecWriter(out io.Writer, args ...string) (io.WriteCloser, error) {
+	w := &execWriter{
+		cmd:    exec.Command(args[0], args[1:]...),
+		stderr: &bytes.Buffer{},
+	}
+	w.cmd.Stdout = out
+	w.cmd.Stderr = w.stderr
+	in, err := w.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	w.in = in
+	if err = w.cmd.Start(); err != nil {
+		return nil, &ExecError{Tool: args[0], Err: err}
+	}
+	return w, nil
+}
+
+// Write passes uncompressed data to the process
+func (w *execWriter) Write(p []byte) (int, error) {
+	return w.in.Write(p)
+}
+
+// Close finishes the stream and waits for the process to flush its output
+func (w *execWriter) Close() error {
+	err := w.in.Close()
+	if werr := w.cmd.Wait(); werr != nil {
+		return &ExecError{
+			Tool:   w.cmd.Args[0],
+			Err:    werr,
+			Stderr: strings.TrimSpace(w.stderr.String()),
+		}
+	}
+	return err
+}
@@ -26,4 +26,7 @@ var (
 
 	// ErrEopkgCorrupted is provided when a file does not conform to eopkg spec
 	ErrEopkgCorrupted = errors.New(".eopkg file is corrupted or invalid")
+
+	// ErrUnknownSuffix is provided when a compressed file lacks the expected suffix
+	ErrUnknownSuffix = errors.New("Filename has an unknown suffix")
 )
@@ -17,38 +17,210 @@
 package shared
 
 import (
-	"os/exec"
+	"bytes"
+	"github.com/ulikunitz/xz"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
 )
 
-// XzFile is a simple wrapper around the xz utility to compress the input
-// file. This will be performed in place and leave a ".xz" suffixed file in
-// place
-// Keep original determines whether we'll keep the original file
-func XzFile(inputPath string, keepOriginal bool) error {
-	cmd := []string{
-		"xz",
-		"-6",
-		"-T", "2",
-		inputPath,
+// xzDictCaps is the dictionary size used by the xz tool for each preset
+var xzDictCaps = [10]int{
+	256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20,
+	8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20,
+}
+
+// NewXzReader will decompress the XZ stream from the input reader without
+// writing anything to disk. The returned reader must be closed to release
+// the decompressor.
+func NewXzReader(in io.Reader, opts CompressOptions) (io.ReadCloser, error) {
+	if opts.Backend == BackendExec {
+		return newExecReader(in, "unxz", "-c", "-T", strconv.Itoa(opts.threads()))
 	}
-	if keepOriginal {
-		cmd = append(cmd, "-k")
+	r, err := xz.NewReader(in)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(r), nil
+}
+
+// NewXzWriter will compress everything written to it as XZ into the output
+// writer. Close must be called to flush the end of the stream.
+//
+// The native backend compresses a single stream when using one thread. With
+// more threads the input is split into blocks that are compressed in parallel
+// as concatenated streams, which the xz format and tools fully support.
+func NewXzWriter(out io.Writer, opts CompressOptions) (io.WriteCloser, error) {
+	level := opts.level()
+	if opts.Backend == BackendExec {
+		return newExecWriter(out, "xz", "-c", "-"+strconv.Itoa(level), "-T", strconv.Itoa(opts.threads()))
+	}
+	cfg := xz.WriterConfig{DictCap: xzDictCaps[level]}
+	if err := cfg.Verify(); err != nil {
+		return nil, err
+	}
+	if opts.threads() == 1 {
+		return cfg.NewWriter(out)
+	}
+	return newXzParallelWriter(out, cfg, opts.threads()), nil
+}
+
+// xzResult is a compressed block waiting to be written out
+type xzResult struct {
+	data []byte
+	err  error
+}
+
+// xzParallelWriter compresses fixed size blocks concurrently, writing them
+// out in their original order
+type xzParallelWriter struct {
+	out    io.Writer
+	cfg    xz.WriterConfig
+	size   int
+	buf    []byte
+	blocks int
+	queue  chan chan xzResult
+	done   chan error
+}
+
+// newXzParallelWriter starts the goroutine writing out compressed blocks
+func newXzParallelWriter(out io.Writer, cfg xz.WriterConfig, threads int) *xzParallelWriter {
+	// Same block size as xz uses for multithreaded compression
+	size := 3 * cfg.DictCap
+	w := &xzParallelWriter{
+		out:   out,
+		cfg:   cfg,
+		size:  size,
+		buf:   make([]byte, 0, size),
+		queue: make(chan chan xzResult, threads),
+		done:  make(chan error, 1),
+	}
+	go w.drain()
+	return w
+}
+
+// drain writes each block once it has been compressed
+func (w *xzParallelWriter) drain() {
+	var err error
+	for result := range w.queue {
+		r := <-result
+		if err != nil {
+			continue
+		}
+		if err = r.err; err == nil {
+			_, err = w.out.Write(r.data)
+		}
+	}
+	w.done <- err
+}
+
+// Write buffers the input, compressing every full block
+func (w *xzParallelWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		free := w.size - len(w.buf)
+		if free > len(p) {
+			free = len(p)
+		}
+		w.buf = append(w.buf, p[:free]...)
+		p = p[free:]
+		if len(w.buf) == w.size {
+			w.compress()
+		}
+	}
+	return n, nil
+}
+
+// compress hands off the current block to a new goroutine
+func (w *xzParallelWriter) compress() {
+	block := w.buf
+	w.buf = make([]byte, 0, w.size)
+	w.blocks++
+	result := make(chan xzResult, 1)
+	w.queue <- result
+	go func() {
+		var dst bytes.Buffer
+		xw, err := w.cfg.NewWriter(&dst)
+		if err == nil {
+			if _, err = xw.Write(block); err == nil {
+				err = xw.Close()
+			}
+		}
+		result <- xzResult{data: dst.Bytes(), err: err}
+	}()
+}
+
+// Close compresses the final block and waits for everything to be written
+func (w *xzParallelWriter) Close() error {
+	// Even empty input must produce a valid stream
+	if len(w.buf) > 0 || w.blocks == 0 {
+		w.compress()
 	}
-	c := exec.Command(cmd[0], cmd[1:]...)
-	return c.Run()
+	close(w.queue)
+	return <-w.done
+}
+
+// XzFile will compress the input file in place, leaving a ".xz" suffixed
+// file, using DefaultCompressOptions.
+// Keep original determines whether we'll keep the original file
+func XzFile(inputPath string, keepOriginal bool) error {
+	return convertFile(inputPath, inputPath+".xz", keepOriginal, func(dst io.Writer, src io.Reader) error {
+		xw, err := NewXzWriter(dst, DefaultCompressOptions)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(xw, src); err != nil {
+			xw.Close()
+			return err
+		}
+		return xw.Close()
+	})
 }
 
 // UnxzFile will decompress the input XZ file and leave a new file in place
 // without the .xz suffix
 func UnxzFile(inputPath string, keepOriginal bool) error {
-	cmd := []string{
-		"unxz",
-		"-T", "2",
-		inputPath,
+	outputPath := strings.TrimSuffix(inputPath, ".xz")
+	return convertFile(inputPath, outputPath, keepOriginal, func(dst io.Writer, src io.Reader) error {
+		xr, err := NewXzReader(src, DefaultCompressOptions)
+		if err != nil {
+			return err
+		}
+		defer xr.Close()
+		_, err = io.Copy(dst, xr)
+		return err
+	})
+}
+
+// convertFile streams inputPath through convert into outputPath, removing
+// the output on failure and the input on success, unless keepOriginal is set
+func convertFile(inputPath, outputPath string, keepOriginal bool, convert func(io.Writer, io.Reader) error) error {
+	if inputPath == outputPath {
+		return ErrUnknownSuffix
+	}
+	src, err := os.Open(inputPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	if err = convert(dst, src); err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(outputPath)
+		return err
 	}
 	if keepOriginal {
-		cmd = append(cmd, "-k")
+		return nil
 	}
-	c := exec.Command(cmd[0], cmd[1:]...)
-	return c.Run()
+	return os.Remove(inputPath)
 }
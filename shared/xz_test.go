@@ -0,0 +1,119 @@
+//
+// Copyright © 2017-2020 Solus Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package shared
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os/exec"
+	"testing"
+)
+
+// testPayload is compressible, and large enough to span several blocks at level 0
+func testPayload() []byte {
+	rng := rand.New(rand.NewSource(1))
+	data := make([]byte, 2<<20)
+	for i := range data {
+		data[i] = byte('a' + rng.Intn(4))
+	}
+	return data
+}
+
+// roundTrip compresses and decompresses data with the given options
+func roundTrip(t *testing.T, data []byte, write, read CompressOptions) {
+	var buf bytes.Buffer
+	xw, err := NewXzWriter(&buf, write)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	if _, err = xw.Write(data); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	if err = xw.Close(); err != nil {
+		t.Fatalf("Failed to finish compression: %v", err)
+	}
+	xr, err := NewXzReader(&buf, read)
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	defer xr.Close()
+	got, err := ioutil.ReadAll(xr)
+	if err != nil {
+		t.Fatalf("Failed to decompress: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Round trip mismatch: got %d bytes, expected %d", len(got), len(data))
+	}
+}
+
+func TestXzNative(t *testing.T) {
+	data := testPayload()
+	roundTrip(t, data, CompressOptions{Level: 0, Threads: 1}, CompressOptions{})
+	roundTrip(t, data, CompressOptions{Level: 0, Threads: 4}, CompressOptions{})
+	roundTrip(t, nil, CompressOptions{Level: 6, Threads: 4}, CompressOptions{})
+}
+
+func TestXzDefaultSingleStream(t *testing.T) {
+	opts := DefaultCompressOptions
+	opts.Level = 0
+	var buf bytes.Buffer
+	xw, err := NewXzWriter(&buf, opts)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	if _, err = xw.Write(testPayload()); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	if err = xw.Close(); err != nil {
+		t.Fatalf("Failed to finish compression: %v", err)
+	}
+	if streams := bytes.Count(buf.Bytes(), []byte("\xfd7zXZ\x00")); streams != 1 {
+		t.Fatalf("Default options should write a single stream, got %d", streams)
+	}
+}
+
+func TestXzExec(t *testing.T) {
+	if _, err := exec.LookPath("xz"); err != nil {
+		t.Skip("xz is not installed")
+	}
+	data := testPayload()
+	native := CompressOptions{Level: 0, Threads: 4}
+	host := CompressOptions{Level: 0, Threads: 2, Backend: BackendExec}
+	roundTrip(t, data, native, host)
+	roundTrip(t, data, host, native)
+}
+
+func TestXzExecError(t *testing.T) {
+	if _, err := exec.LookPath("unxz"); err != nil {
+		t.Skip("unxz is not installed")
+	}
+	xr, err := NewXzReader(bytes.NewBufferString("not xz"), CompressOptions{Backend: BackendExec})
+	if err != nil {
+		t.Fatalf("Failed to start unxz: %v", err)
+	}
+	defer xr.Close()
+	_, err = ioutil.ReadAll(xr)
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		t.Fatalf("Expected an ExecError, got: %v", err)
+	}
+	if execErr.Stderr == "" {
+		t.Fatalf("Expected unxz to explain the failure")
+	}
+}